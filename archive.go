@@ -0,0 +1,127 @@
+package ciel
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os/exec"
+)
+
+// ArchiveFormat is the format of archives exported or imported by FileSystem.
+type ArchiveFormat string
+
+const (
+	FormatTar     ArchiveFormat = "tar"
+	FormatTarGzip ArchiveFormat = "tar.gz"
+	FormatTarZstd ArchiveFormat = "tar.zst" // needs "zstd" in PATH
+	FormatTarXz   ArchiveFormat = "tar.xz"  // needs "xz" in PATH
+
+	// FormatSquashfs is only supported by ExportRootfs(),
+	// it needs "mksquashfs" (squashfs-tools 4.6 or later) in PATH.
+	FormatSquashfs ArchiveFormat = "squashfs"
+)
+
+const (
+	ZstdProc       = "zstd"
+	XzProc         = "xz"
+	MksquashfsProc = "mksquashfs"
+)
+
+// compressWriter returns a writer compressing the tar stream to w.
+// It must be closed to flush the data.
+func compressWriter(w io.Writer, format ArchiveFormat) (io.WriteCloser, error) {
+	switch format {
+	case FormatTar:
+		return nopWriteCloser{w}, nil
+	case FormatTarGzip:
+		return gzip.NewWriter(w), nil
+	case FormatTarZstd:
+		return procWriter(w, ZstdProc, "-q", "-c", "-T0")
+	case FormatTarXz:
+		return procWriter(w, XzProc, "-q", "-c", "-T0")
+	}
+	return nil, fmt.Errorf("unsupported archive format: %q", format)
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error {
+	return nil
+}
+
+// procWriter pipes the data through an external compressor.
+func procWriter(w io.Writer, proc string, args ...string) (io.WriteCloser, error) {
+	dbglog.Println("procWriter:", proc, args)
+	cmd := exec.Command(proc, args...)
+	cmd.Stdout = w
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+	return &cmdWriteCloser{stdin, cmd}, nil
+}
+
+type cmdWriteCloser struct {
+	io.WriteCloser
+	cmd *exec.Cmd
+}
+
+func (c *cmdWriteCloser) Close() error {
+	if err := c.WriteCloser.Close(); err != nil {
+		return err
+	}
+	return c.cmd.Wait()
+}
+
+// decompressReader detects the compression of r by its magic number,
+// and returns a reader of the decompressed data. It must be closed.
+func decompressReader(r io.Reader) (io.ReadCloser, error) {
+	br := bufio.NewReader(r)
+	magic, err := br.Peek(6)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	switch {
+	case bytes.HasPrefix(magic, []byte{0x1f, 0x8b}):
+		return gzip.NewReader(br)
+	case bytes.HasPrefix(magic, []byte{0x28, 0xb5, 0x2f, 0xfd}):
+		return procReader(br, ZstdProc, "-q", "-d", "-c")
+	case bytes.HasPrefix(magic, []byte{0xfd, '7', 'z', 'X', 'Z', 0x00}):
+		return procReader(br, XzProc, "-q", "-d", "-c")
+	}
+	return ioutil.NopCloser(br), nil
+}
+
+// procReader pipes the data through an external decompressor.
+func procReader(r io.Reader, proc string, args ...string) (io.ReadCloser, error) {
+	dbglog.Println("procReader:", proc, args)
+	cmd := exec.Command(proc, args...)
+	cmd.Stdin = r
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+	return &cmdReadCloser{stdout, cmd}, nil
+}
+
+type cmdReadCloser struct {
+	io.ReadCloser
+	cmd *exec.Cmd
+}
+
+func (c *cmdReadCloser) Close() error {
+	// drain it, or the process may be blocked forever.
+	io.Copy(ioutil.Discard, c.ReadCloser)
+	return c.cmd.Wait()
+}
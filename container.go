@@ -2,17 +2,25 @@ package ciel
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"io"
 	"os"
+	"strconv"
+	"strings"
 	"sync"
 )
 
 // ShellPath is the path of shell in container.
 const ShellPath = "/bin/bash"
 
-// FileSystemLayers specifies the layer structure of file system
+// FileSystemLayers specifies the default layer structure of file system.
+// Use WithLayers() to specify it per container.
 var FileSystemLayers Layers
 
+// ErrActive is returned when an operation needs the container to be stopped.
+var ErrActive = errors.New("the container is active")
+
 // Container represents an instance of your container.
 //
 // FIXME: It's not coroutine-safe so far.
@@ -22,6 +30,10 @@ type Container struct {
 	Name       string
 	Fs         *FileSystem
 	properties []string
+	privUsers  PrivateUsers
+
+	readOnly bool
+	volatile bool
 
 	boot       bool
 	booted     bool
@@ -30,17 +42,102 @@ type Container struct {
 	chrooted bool
 }
 
+// Option configures a container created by New() or Discover().
+type Option func(*options)
+
+type options struct {
+	layers    Layers
+	ephemeral bool
+	rootless  bool
+	readOnly  bool
+	volatile  bool
+}
+
+// WithLayers specifies the layer structure of the file system,
+// instead of the global FileSystemLayers.
+func WithLayers(layers Layers) Option {
+	return func(o *options) {
+		o.layers = layers
+	}
+}
+
+// WithEphemeral makes the file system ephemeral, so changes in the
+// container are thrown away, see FileSystem.SetEphemeral().
+func WithEphemeral() Option {
+	return func(o *options) {
+		o.ephemeral = true
+	}
+}
+
+// WithRootless makes the container usable without root, see
+// FileSystem.SetRootless(). It's never booted.
+func WithRootless() Option {
+	return func(o *options) {
+		o.rootless = true
+	}
+}
+
+// WithReadOnly makes the container read-only, see Container.SetReadOnly().
+func WithReadOnly(volatile bool) Option {
+	return func(o *options) {
+		o.readOnly = true
+		o.volatile = volatile
+	}
+}
+
 // New creates a container descriptor, but it won't start the container immediately.
+// Invalid layers, see Layers.Validate(), are only warned about, since they may
+// be set up later; Discover() and NewFileSystem() reject them.
 //
 // You may want to call Command() after this.
-func New(name, baseDir string) *Container {
+func New(name, baseDir string, opts ...Option) *Container {
+	o := newOptions(opts)
+	if err := o.layers.Validate(); err != nil {
+		warnlog.Println("New:", err)
+	}
+	return o.container(name, newFileSystem(baseDir, o.layers))
+}
+
+// Discover is New(), but the layers are discovered from the directories
+// in baseDir by DiscoverLayers().
+func Discover(name, baseDir string, opts ...Option) (*Container, error) {
+	layers, err := DiscoverLayers(baseDir)
+	if err != nil {
+		return nil, err
+	}
+	return newContainer(name, baseDir, append([]Option{WithLayers(layers)}, opts...))
+}
+
+func newContainer(name, baseDir string, opts []Option) (*Container, error) {
+	o := newOptions(opts)
+	fs, err := NewFileSystem(baseDir, o.layers)
+	if err != nil {
+		return nil, err
+	}
+	return o.container(name, fs), nil
+}
+
+func newOptions(opts []Option) *options {
+	o := &options{layers: FileSystemLayers}
+	for _, opt := range opts {
+		opt(o)
+	}
+	return o
+}
+
+// container creates a container on the file system with the options.
+func (o *options) container(name string, fs *FileSystem) *Container {
+	fs.SetEphemeral(o.ephemeral)
+	fs.SetRootless(o.rootless)
 	c := &Container{
 		Name:       name,
+		Fs:         fs,
 		properties: []string{},
 		boot:       true,
 		cancelBoot: make(chan struct{}),
+		readOnly:   o.readOnly,
+		volatile:   o.volatile,
 	}
-	c.Fs = newFileSystem(baseDir, FileSystemLayers)
 	return c
 }
 
@@ -83,10 +180,16 @@ func (c *Container) ShellContext(ctx context.Context) int {
 
 // CommandRawContext is CommandRaw() with context.
 func (c *Container) CommandRawContext(ctx context.Context, proc string, stdin io.Reader, stdout, stderr io.Writer, args ...string) int {
-	if !c.Fs.IsMounted() {
-		if err := c.Fs.Mount(); err != nil {
-			panic(err)
-		}
+	c.lock.RLock()
+	readOnly := c.readOnly
+	c.lock.RUnlock()
+	// a read-only container refuses a file system mounted read-write.
+	mount := c.Fs.Mount
+	if readOnly {
+		mount = c.Fs.MountReadOnly
+	}
+	if err := mount(); err != nil {
+		panic(err)
 	}
 	c.lock.RLock()
 	booted := c.booted
@@ -95,8 +198,9 @@ func (c *Container) CommandRawContext(ctx context.Context, proc string, stdin io
 	if booted {
 		return c.systemdRun(ctx, proc, stdin, stdout, stderr, args...)
 	}
-	if boot && c.Fs.IsBootable() {
+	if boot && !c.Fs.IsRootless() && c.Fs.IsBootable() {
 		c.systemdNspawnBoot()
+		c.recordOwnershipShift()
 		return c.systemdRun(ctx, proc, stdin, stdout, stderr, args...)
 	}
 	return c.systemdNspawnRun(ctx, proc, stdin, stdout, stderr, args...)
@@ -107,6 +211,22 @@ func (c *Container) Shutdown() error {
 	return c.machinectlShutdown()
 }
 
+// Reset discards all changes in the top layer of the file system,
+// except the paths to preserve. See FileSystem.Reset().
+func (c *Container) Reset(preserve ...string) error {
+	// the file system can't be mounted to start the container while it's
+	// locked, and the lock order is c.Fs.lock, then c.lock.
+	c.Fs.lock.Lock()
+	defer c.Fs.lock.Unlock()
+	c.lock.RLock()
+	active := c.booted || c.chrooted
+	c.lock.RUnlock()
+	if active {
+		return ErrActive
+	}
+	return c.Fs.reset(preserve...)
+}
+
 // IsActive returns whether the container is running or not.
 func (c *Container) IsActive() bool {
 	c.lock.RLock()
@@ -126,6 +246,38 @@ func (c *Container) SetPreference(boot bool) {
 	c.lock.Unlock()
 }
 
+// SetReadOnly makes the container read-only, for inspections and tests
+// which must not change the top layer. The file system is mounted by
+// MountReadOnly(), and systemd-nspawn runs with "--read-only".
+//
+// <volatile>: a tmpfs is mounted on /tmp, and /var is overlaid with a
+// temporary directory, so programs needing them can run. The changes
+// are thrown away when the container stops.
+//
+// It will go into effect at the next mount. In the rootless mode, only the
+// file system is read-only. If the file system is already mounted
+// read-write, CommandRaw() panics with ErrMountedReadWrite.
+func (c *Container) SetReadOnly(readOnly, volatile bool) {
+	c.lock.Lock()
+	c.readOnly = readOnly
+	c.volatile = volatile
+	c.lock.Unlock()
+}
+
+// readOnlyArgs returns the arguments of systemd-nspawn for the read-only mode.
+// It must be called with c.lock held.
+func (c *Container) readOnlyArgs() []string {
+	if !c.readOnly {
+		return nil
+	}
+	args := []string{"--read-only"}
+	if c.volatile {
+		// an empty upper directory is a temporary one, see systemd-nspawn(1).
+		args = append(args, "--tmpfs=/tmp", "--overlay=+/var::/var")
+	}
+	return args
+}
+
 // SetProperties specifies the properties of container (only for boot-mode).
 //
 // You may use SetProperty() instead. For clear settings, use SetProperties(nil).
@@ -153,3 +305,62 @@ func (c *Container) SetProperty(property string) {
 	infolog.Printf("properties = %v\n", c.properties)
 	c.lock.Unlock()
 }
+
+// PrivateUsers configures the user namespace of systemd-nspawn, see
+// "--private-users" and "--private-users-ownership" in systemd-nspawn(1).
+// The zero value leaves both to systemd-nspawn.
+type PrivateUsers struct {
+	// Users is "no", "yes", "pick", "identity", or a range of UIDs as
+	// "<first>[:<count>]", eg. "524288:65536".
+	Users string `json:"users,omitempty"`
+
+	// Ownership is "off", "chown", "map" or "auto". "chown" shifts the
+	// ownership of every file, so they are copied up into the top layer,
+	// and the shift is recorded, see FileSystem.OwnershipShift();
+	// use ShiftOwnership() before merging or exporting it elsewhere.
+	// "map" (Linux 5.12 or later) maps the ownership without changing it.
+	Ownership string `json:"ownership,omitempty"`
+}
+
+// SetPrivateUsers sets the user namespace of the container. It will go into
+// effect at the next start of the container.
+func (c *Container) SetPrivateUsers(pu PrivateUsers) error {
+	if err := pu.check(); err != nil {
+		errlog.Println("SetPrivateUsers:", err)
+		return err
+	}
+	c.lock.Lock()
+	c.privUsers = pu
+	infolog.Printf("private users = %+v\n", pu)
+	c.lock.Unlock()
+	return nil
+}
+
+func (pu PrivateUsers) check() error {
+	switch pu.Users {
+	case "", "no", "yes", "pick", "identity":
+	default:
+		fields := strings.SplitN(pu.Users, ":", 2)
+		for _, f := range fields {
+			if _, err := strconv.ParseUint(f, 10, 32); err != nil {
+				return fmt.Errorf("invalid private users: %q", pu.Users)
+			}
+		}
+	}
+	if pu.Ownership != "" && !isOneOf(pu.Ownership, []string{"off", "chown", "map", "auto"}) {
+		return fmt.Errorf("invalid private users ownership: %q", pu.Ownership)
+	}
+	return nil
+}
+
+// args returns the arguments of systemd-nspawn.
+func (pu PrivateUsers) args() []string {
+	var args []string
+	if pu.Users != "" {
+		args = append(args, "--private-users="+pu.Users)
+	}
+	if pu.Ownership != "" {
+		args = append(args, "--private-users-ownership="+pu.Ownership)
+	}
+	return args
+}
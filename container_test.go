@@ -0,0 +1,36 @@
+package ciel
+
+import "testing"
+
+// TestNewLenient checks that New() accepts layers which are set up later,
+// like it always did, while Discover() and NewFileSystem() validate them.
+func TestNewLenient(t *testing.T) {
+	saved := FileSystemLayers
+	defer func() { FileSystemLayers = saved }()
+	FileSystemLayers = nil
+
+	for _, layers := range []Layers{nil, {"99-upper", "99-lower"}, {"10-upper", "50-lower"}} {
+		c := New("test", t.TempDir(), WithLayers(layers))
+		if c.Fs == nil || len(c.Fs.layers) != len(layers) {
+			t.Errorf("New(%q) has no file system with the layers", layers)
+		}
+		if _, err := NewFileSystem(t.TempDir(), layers); err == nil {
+			t.Errorf("NewFileSystem(%q) returned no error", layers)
+		}
+	}
+	if c := New("test", t.TempDir()); c.Fs == nil {
+		t.Error("New() without FileSystemLayers has no file system")
+	}
+}
+
+func TestResetActive(t *testing.T) {
+	c := New("test", t.TempDir(), WithLayers(Layers{"99-top", "00-bottom"}))
+	c.chrooted = true
+	if err := c.Reset(); err != ErrActive {
+		t.Errorf("Reset: %v, want %v", err, ErrActive)
+	}
+	c.chrooted = false
+	if err := c.Reset(); err != nil {
+		t.Errorf("Reset: %v", err)
+	}
+}
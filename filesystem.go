@@ -1,7 +1,11 @@
 package ciel
 
 import (
+	"errors"
+	"fmt"
+	"io/ioutil"
 	"path/filepath"
+	"sort"
 	"strings"
 	"sync"
 )
@@ -20,16 +24,82 @@ func (ll Layers) Path(name string) string {
 
 // Index returns the index of layer in array.
 func (ll Layers) Index(name string) int {
+	if pos := ll.find(name); pos != -1 {
+		return pos
+	}
+	errlog.Panicln("no such layer: " + name)
+	return -1
+}
+
+// find is Index(), but it returns -1 instead of panicking.
+func (ll Layers) find(name string) int {
 	for pos, fullname := range ll {
 		fullnameSlice := strings.SplitN(fullname, "-", 2)
-		if name == fullnameSlice[1] {
+		if len(fullnameSlice) == 2 && name == fullnameSlice[1] {
 			return pos
 		}
 	}
-	errlog.Panicln("no such layer: " + name)
 	return -1
 }
 
+// Validate checks that every layer is named like "NN-name", the names are
+// unique, and the layers are sorted from top to bottom by their numbers.
+func (ll Layers) Validate() error {
+	if len(ll) == 0 {
+		return errors.New("no layers")
+	}
+	names := make(map[string]bool)
+	last := -1
+	for i, fullname := range ll {
+		num, _, err := layerNumber(fullname)
+		if err != nil {
+			return err
+		}
+		name := layerName(fullname)
+		if name == "" || strings.ContainsRune(name, filepath.Separator) {
+			return fmt.Errorf("invalid layer: %q", fullname)
+		}
+		if names[name] {
+			return fmt.Errorf("duplicate layer: %q", name)
+		}
+		names[name] = true
+		if i != 0 && num >= last {
+			return fmt.Errorf("layers are not sorted from top to bottom: %q", fullname)
+		}
+		last = num
+	}
+	return nil
+}
+
+// DiscoverLayers scans baseDir for the directories of layers named like
+// "NN-name", and sorts them from top to bottom.
+func DiscoverLayers(baseDir string) (Layers, error) {
+	infos, err := ioutil.ReadDir(baseDir)
+	if err != nil {
+		return nil, err
+	}
+	var layers Layers
+	for _, info := range infos {
+		name := info.Name()
+		if !info.IsDir() || strings.HasSuffix(name, WorkDirSuffix) {
+			continue
+		}
+		if _, _, err := layerNumber(name); err != nil {
+			continue
+		}
+		layers = append(layers, name)
+	}
+	sort.SliceStable(layers, func(i, j int) bool {
+		inum, _, _ := layerNumber(layers[i])
+		jnum, _, _ := layerNumber(layers[j])
+		return inum > jnum
+	})
+	if err := layers.Validate(); err != nil {
+		return nil, err
+	}
+	return layers, nil
+}
+
 // FileSystem contains the layers of overlay file system and implements
 // methods to operate it, such as Mount() and Unmount().
 type FileSystem struct {
@@ -41,9 +111,41 @@ type FileSystem struct {
 	base   string
 	target string
 
+	// overlay is the mount options of overlayfs, see SetOverlayOptions().
+	overlay OverlayOptions
+
+	// ephemeral makes mounts use a throwaway upper directory, see SetEphemeral().
+	ephemeral bool
+	// tmpfsUpper puts the upper directory on tmpfs, see SetTmpfsUpper().
+	tmpfsUpper bool
+	tmpfsSize  string
+	// persistOnUnmount saves the tmpfs upper by Unmount(), see SetPersistOnUnmount().
+	persistOnUnmount bool
+
+	// scratch is the directory holding the upper and work directories of
+	// an ephemeral or tmpfs-backed mount, while it's mounted.
+	scratch      string
+	scratchTmpfs bool
+	// staleTops are the top layers replaced by persisting, to be removed
+	// after unmounting.
+	staleTops []string
+
+	// rootless mounts the file system in a user namespace, see SetRootless().
+	rootless   bool
+	rootlessNS *rootlessNS
+
 	mounted bool
+	// readOnly is whether the current mount is read-only.
+	readOnly bool
 }
 
+// ErrMounted is returned when an operation needs the file system to be unmounted.
+var ErrMounted = errors.New("the file system is mounted")
+
+// ErrMountedReadWrite is returned by MountReadOnly() when the file system is
+// already mounted read-write.
+var ErrMountedReadWrite = errors.New("the file system is mounted read-write")
+
 // WorkDirSuffix is the suffix of workdir. It appends to the upperdir (TopLayer).
 const WorkDirSuffix = ".work"
 
@@ -93,6 +195,62 @@ func (fs *FileSystem) EnableLayer(names ...string) {
 	}
 }
 
+// SetUserXattr makes the file system use "user.overlay.*" extended attributes
+// instead of "trusted.overlay.*" ones, for both mounting ("userxattr" option)
+// and MergeFile(). It will go into effect at the next mount.
+//
+// It's a shortcut of OverlayOptions.UserXattr, without checking the kernel.
+func (fs *FileSystem) SetUserXattr(enable bool) {
+	fs.overlay.UserXattr = enable
+}
+
+// SetEphemeral makes the mounts of the file system ephemeral, like
+// "systemd-nspawn --ephemeral": all layers, including the top layer, are
+// mounted read-only, and changes go to a throwaway upper directory on tmpfs,
+// which is removed by Unmount(). It will go into effect at the next mount.
+//
+// Ephemeral mounts of the same layers can coexist, see Ephemeral(), but the
+// top layer must not be mounted as upper directory by another file system.
+func (fs *FileSystem) SetEphemeral(enable bool) {
+	fs.ephemeral = enable
+}
+
+// Ephemeral returns a new file system with the same layers and options,
+// whose mounts are ephemeral. It can be mounted at the same time as fs,
+// if fs is ephemeral too.
+func (fs *FileSystem) Ephemeral() *FileSystem {
+	fs.lock.RLock()
+	defer fs.lock.RUnlock()
+	efs := newFileSystem(fs.base, fs.layers)
+	copy(efs.layersMask, fs.layersMask)
+	efs.overlay = fs.overlay
+	efs.rootless = fs.rootless
+	efs.ephemeral = true
+	return efs
+}
+
+// SetTmpfsUpper puts the upper and work directories on a tmpfs of size,
+// eg. "4G" or "50%" (of the memory), or the default size of tmpfs if size is
+// empty. The top layer is mounted read-only below the upper directory, and
+// changes are lost by Unmount(), unless they are saved by PersistUpper() or
+// SetPersistOnUnmount().
+// It's not supported in the rootless mode, where the mount fails with
+// ErrRootless. It will go into effect at the next mount.
+func (fs *FileSystem) SetTmpfsUpper(enable bool, size string) {
+	fs.tmpfsUpper = enable
+	fs.tmpfsSize = size
+}
+
+// SetVolatile mounts overlayfs with the "volatile" option, which skips
+// syncing the upper directory to the disk. If the system crashes while it's
+// mounted, the changes in the top layer may be partially lost.
+// It will go into effect at the next mount.
+//
+// It's a shortcut of OverlayOptions.Volatile, without checking the kernel.
+func (fs *FileSystem) SetVolatile(enable bool) {
+	fs.overlay.Volatile = enable
+}
+
 // TargetDir returns the path of merged directory.
 //
 // Do not access TargetDir before or after file system is active (mounted).
@@ -101,10 +259,19 @@ func (fs *FileSystem) TargetDir() string {
 	return fs.target
 }
 
+// NewFileSystem creates a file system with layers in the base directory.
+// The layers are validated by Layers.Validate().
+func NewFileSystem(base string, layers Layers) (*FileSystem, error) {
+	if err := layers.Validate(); err != nil {
+		return nil, err
+	}
+	return newFileSystem(base, layers), nil
+}
+
 func newFileSystem(base string, layers Layers) *FileSystem {
 	fs := new(FileSystem)
 	fs.base = base
-	fs.layers = layers
+	fs.layers = append(Layers{}, layers...)
 	fs.layersMask = make([]bool, len(fs.layers))
 	fs.EnableAll()
 	return fs
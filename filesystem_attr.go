@@ -0,0 +1,104 @@
+package ciel
+
+import (
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+// fileAttrs is a snapshot of the attributes of a file,
+// which can be applied to another file, or restored.
+type fileAttrs struct {
+	Mode   uint32            `json:"mode"` // permission bits, with setuid, setgid and sticky
+	UID    int               `json:"uid"`
+	GID    int               `json:"gid"`
+	Atime  syscall.Timespec  `json:"atime"`
+	Mtime  syscall.Timespec  `json:"mtime"`
+	Xattrs map[string][]byte `json:"xattrs,omitempty"`
+
+	Symlink bool `json:"symlink,omitempty"` // the mode of symbolic links is meaningless
+}
+
+func readAttrs(path string) (*fileAttrs, error) {
+	info, err := os.Lstat(path)
+	if err != nil {
+		return nil, err
+	}
+	st := info.Sys().(*syscall.Stat_t)
+	xattrs, err := lxattrs(path)
+	if err != nil {
+		return nil, err
+	}
+	return &fileAttrs{
+		Mode:    st.Mode & 07777,
+		UID:     int(st.Uid),
+		GID:     int(st.Gid),
+		Atime:   st.Atim,
+		Mtime:   st.Mtim,
+		Xattrs:  xattrs,
+		Symlink: info.Mode()&os.ModeSymlink != 0,
+	}, nil
+}
+
+// restore applies the attributes to path, and removes the extended attributes
+// which are not in the snapshot.
+func (a *fileAttrs) restore(path string) error {
+	return a.apply(path, true)
+}
+
+// apply applies the attributes to path. Unless overlay is true, private
+// extended attributes of overlayfs are neither copied nor removed.
+func (a *fileAttrs) apply(path string, overlay bool) error {
+	// chown() clears setuid and setgid bits and capabilities, do it first.
+	if err := os.Lchown(path, a.UID, a.GID); err != nil {
+		return err
+	}
+	if !a.Symlink {
+		if err := syscall.Chmod(path, a.Mode); err != nil {
+			return err
+		}
+	}
+	names, err := llistxattr(path)
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		if !overlay && isOverlayXattr(name) {
+			continue
+		}
+		if _, ok := a.Xattrs[name]; !ok {
+			if err := lremovexattr(path, name); err != nil && err != syscall.ENODATA {
+				return err
+			}
+		}
+	}
+	for name, value := range a.Xattrs {
+		if !overlay && isOverlayXattr(name) {
+			continue
+		}
+		if err := lsetxattr(path, name, value, 0); err != nil {
+			return err
+		}
+	}
+	return lutimesNano(path, a.Atime, a.Mtime)
+}
+
+// lutimesNano is syscall.UtimesNano(), but it does not follow symbolic links.
+func lutimesNano(path string, atime, mtime syscall.Timespec) error {
+	const (
+		atFdcwd           = -0x64
+		atSymlinkNofollow = 0x100
+	)
+	p, err := syscall.BytePtrFromString(path)
+	if err != nil {
+		return err
+	}
+	ts := [2]syscall.Timespec{atime, mtime}
+	fd := atFdcwd
+	_, _, e1 := syscall.Syscall6(syscall.SYS_UTIMENSAT, uintptr(fd),
+		uintptr(unsafe.Pointer(p)), uintptr(unsafe.Pointer(&ts[0])), atSymlinkNofollow, 0, 0)
+	if e1 != 0 {
+		return e1
+	}
+	return nil
+}
@@ -0,0 +1,232 @@
+package ciel
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+// scratchDirs returns a directory in TMPDIR, and one on a tmpfs if it can be
+// mounted, so the attributes are tested on both.
+func scratchDirs(t *testing.T) map[string]string {
+	t.Helper()
+	if os.Geteuid() != 0 {
+		t.Skip("needs root")
+	}
+	dirs := make(map[string]string)
+	for _, name := range []string{"tmpdir", "tmpfs"} {
+		dir, err := ioutil.TempDir("", "ciel-test.")
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { os.RemoveAll(dir) })
+		if name == "tmpfs" {
+			if err := syscall.Mount("tmpfs", dir, "tmpfs", 0, "mode=0755"); err != nil {
+				t.Log("no tmpfs:", err)
+				continue
+			}
+			t.Cleanup(func() { syscall.Unmount(dir, 0) })
+		}
+		dirs[name] = dir
+	}
+	return dirs
+}
+
+// capabilityXattr is "security.capability" of version 2 with CAP_NET_RAW
+// permitted and effective.
+func capabilityXattr() []byte {
+	const (
+		vfsCapRevision2 = 0x02000000
+		vfsCapEffective = 0x000001
+		capNetRaw       = 13
+	)
+	var b bytes.Buffer
+	for _, v := range []uint32{vfsCapRevision2 | vfsCapEffective, 1 << capNetRaw, 0, 0, 0} {
+		binary.Write(&b, binary.LittleEndian, v)
+	}
+	return b.Bytes()
+}
+
+// aclXattr is "system.posix_acl_access" giving read access to uid 1000.
+// It sets the mode to 0644, the group bits being the mask.
+func aclXattr() []byte {
+	const (
+		aclVersion  = 2
+		aclUserObj  = 0x01
+		aclUser     = 0x02
+		aclGroupObj = 0x04
+		aclMask     = 0x10
+		aclOther    = 0x20
+		aclUndefID  = 0xffffffff
+	)
+	var b bytes.Buffer
+	binary.Write(&b, binary.LittleEndian, uint32(aclVersion))
+	for _, e := range []struct {
+		tag, perm uint16
+		id        uint32
+	}{
+		{aclUserObj, 6, aclUndefID},
+		{aclUser, 4, 1000},
+		{aclGroupObj, 4, aclUndefID},
+		{aclMask, 4, aclUndefID},
+		{aclOther, 4, aclUndefID},
+	} {
+		binary.Write(&b, binary.LittleEndian, e)
+	}
+	return b.Bytes()
+}
+
+func TestCopyAttributes(t *testing.T) {
+	tests := []struct {
+		name   string
+		dir    bool
+		mode   uint32
+		xattrs map[string][]byte
+	}{
+		{name: "setuid", mode: 04755},
+		{name: "setgid dir", dir: true, mode: 02775},
+		{name: "sticky dir", dir: true, mode: 01777},
+		{name: "user xattr", mode: 0644, xattrs: map[string][]byte{"user.ciel.test": []byte("value")}},
+		{name: "capability", mode: 0755, xattrs: map[string][]byte{"security.capability": capabilityXattr()}},
+		{name: "capability and setuid", mode: 04755, xattrs: map[string][]byte{"security.capability": capabilityXattr()}},
+		{name: "acl", mode: 0644, xattrs: map[string][]byte{"system.posix_acl_access": aclXattr()}},
+		{name: "acl dir", dir: true, mode: 0644, xattrs: map[string][]byte{"system.posix_acl_access": aclXattr()}},
+	}
+	for fsname, root := range scratchDirs(t) {
+		for i, tt := range tests {
+			t.Run(fsname+"/"+tt.name, func(t *testing.T) {
+				src := filepath.Join(root, "src", string(rune('a'+i)))
+				dst := filepath.Join(root, "dst", string(rune('a'+i)))
+				for _, path := range []string{src, dst} {
+					if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+						t.Fatal(err)
+					}
+					var err error
+					if tt.dir {
+						err = os.Mkdir(path, 0700)
+					} else {
+						err = ioutil.WriteFile(path, nil, 0600)
+					}
+					if err != nil {
+						t.Fatal(err)
+					}
+				}
+
+				if err := os.Lchown(src, 1234, 5678); err != nil {
+					t.Fatal(err)
+				}
+				if err := syscall.Chmod(src, tt.mode); err != nil {
+					t.Fatal(err)
+				}
+				for name, value := range tt.xattrs {
+					if err := lsetxattr(src, name, value, 0); err == syscall.ENOTSUP || err == syscall.EOPNOTSUPP {
+						t.Skipf("%s: %v", name, err)
+					} else if err != nil {
+						t.Fatal(name, err)
+					}
+				}
+				atime := syscall.Timespec{Sec: 1500000000, Nsec: 123456789}
+				mtime := syscall.Timespec{Sec: 1600000000, Nsec: 987654321}
+				if err := lutimesNano(src, atime, mtime); err != nil {
+					t.Fatal(err)
+				}
+
+				if err := copyAttributes(src, dst); err != nil {
+					t.Fatal("copyAttributes:", err)
+				}
+
+				want, err := readAttrs(src)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if want.Mode != tt.mode {
+					t.Fatalf("the mode of the source is %o, want %o", want.Mode, tt.mode)
+				}
+				for name := range tt.xattrs {
+					if _, ok := want.Xattrs[name]; !ok {
+						t.Fatalf("the source has no %s", name)
+					}
+				}
+				got, err := readAttrs(dst)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if got.Mode != want.Mode {
+					t.Errorf("mode = %o, want %o", got.Mode, want.Mode)
+				}
+				if got.UID != 1234 || got.GID != 5678 {
+					t.Errorf("owner = %d:%d, want 1234:5678", got.UID, got.GID)
+				}
+				if got.Mtime != mtime {
+					t.Errorf("mtime = %v, want %v", got.Mtime, mtime)
+				}
+				if got.Atime != atime {
+					t.Errorf("atime = %v, want %v", got.Atime, atime)
+				}
+				for name, value := range want.Xattrs {
+					if !bytes.Equal(got.Xattrs[name], value) {
+						t.Errorf("%s = %x, want %x", name, got.Xattrs[name], value)
+					}
+				}
+				for name := range got.Xattrs {
+					if _, ok := want.Xattrs[name]; !ok {
+						t.Errorf("unexpected %s", name)
+					}
+				}
+			})
+		}
+	}
+}
+
+// TestCopyAttributesOverlayXattrs checks that private extended attributes of
+// overlayfs are neither copied nor removed.
+func TestCopyAttributesOverlayXattrs(t *testing.T) {
+	for fsname, root := range scratchDirs(t) {
+		t.Run(fsname, func(t *testing.T) {
+			src, dst := filepath.Join(root, "src"), filepath.Join(root, "dst")
+			for _, dir := range []string{src, dst} {
+				if err := os.Mkdir(dir, 0755); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := setOpaque(src, false); err != nil {
+				t.Fatal(err)
+			}
+			if err := lsetxattr(dst, overlayXattrPrefix+"redirect", []byte("/x"), 0); err != nil {
+				t.Fatal(err)
+			}
+			if err := copyAttributes(src, dst); err != nil {
+				t.Fatal("copyAttributes:", err)
+			}
+			if isOpaque(dst) {
+				t.Error("the opaque attribute is copied")
+			}
+			if _, err := lgetxattr(dst, overlayXattrPrefix+"redirect"); err != nil {
+				t.Error("the redirect attribute is removed:", err)
+			}
+		})
+	}
+}
+
+func TestCopyAttributesError(t *testing.T) {
+	root, err := ioutil.TempDir("", "ciel-test.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	existing := filepath.Join(root, "existing")
+	if err := ioutil.WriteFile(existing, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	missing := filepath.Join(root, "missing")
+	if err := copyAttributes(missing, existing); err == nil {
+		t.Error("copyAttributes from a missing file returned no error")
+	}
+	if err := copyAttributes(existing, missing); err == nil {
+		t.Error("copyAttributes to a missing file returned no error")
+	}
+}
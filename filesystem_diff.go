@@ -0,0 +1,261 @@
+package ciel
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+// ChangeKind is the kind of a change in a layer.
+type ChangeKind string
+
+const (
+	ChangeAdded    ChangeKind = "added"
+	ChangeModified ChangeKind = "modified"
+	ChangeDeleted  ChangeKind = "deleted"
+	ChangeOpaque   ChangeKind = "opaque" // a directory replaced as a whole
+)
+
+// Change is a path changed by a layer, compared with the layers below it.
+//
+// For ChangeModified, Content tells whether the content (or the type of file)
+// differs, and Mode, Owner and Xattrs tell which metadata differs.
+type Change struct {
+	Path string     `json:"path"`
+	Kind ChangeKind `json:"kind"`
+
+	Content bool `json:"content,omitempty"`
+	Mode    bool `json:"mode,omitempty"`
+	Owner   bool `json:"owner,omitempty"`
+	Xattrs  bool `json:"xattrs,omitempty"`
+}
+
+// String formats the change like "M /usr/bin/foo (content,mode)".
+func (c Change) String() string {
+	var flags []string
+	if c.Content {
+		flags = append(flags, "content")
+	}
+	if c.Mode {
+		flags = append(flags, "mode")
+	}
+	if c.Owner {
+		flags = append(flags, "owner")
+	}
+	if c.Xattrs {
+		flags = append(flags, "xattrs")
+	}
+	s := strings.ToUpper(string(c.Kind[:1])) + " " + c.Path
+	if len(flags) != 0 {
+		s += " (" + strings.Join(flags, ",") + ")"
+	}
+	return s
+}
+
+// Changes is a list of changes, sorted by path.
+type Changes []Change
+
+// WriteText writes the changes line by line.
+func (cs Changes) WriteText(w io.Writer) error {
+	for _, c := range cs {
+		if _, err := fmt.Fprintln(w, c.String()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// WriteJSON writes the changes as a JSON array.
+func (cs Changes) WriteJSON(w io.Writer) error {
+	if cs == nil {
+		cs = Changes{}
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(cs)
+}
+
+// Diff lists the changes made by the layer upper, compared with the merged view
+// of the layers from the one below upper down to lower. Disabled layers are ignored.
+// An opaque directory replaces the directory below as a whole: it's reported as
+// ChangeOpaque, and everything in it as added.
+func (fs *FileSystem) Diff(upper, lower string) (Changes, error) {
+	uindex, lindex := fs.layers.Index(upper), fs.layers.Index(lower)
+	if uindex >= lindex {
+		return nil, errors.New("Diff: the upper layer must be above the lower layer")
+	}
+	uroot := fs.Layer(upper)
+
+	var changes Changes
+	var opaques []string
+	err := filepath.Walk(uroot, func(upath string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if upath == uroot {
+			return nil
+		}
+		rel, _ := filepath.Rel(uroot, upath)
+		utp, err := overlayTypeOf(upath, info, err)
+		if err != nil {
+			return err
+		}
+
+		var base *layerEntry
+		if !underAny(rel, opaques) {
+			chain, err := fs.lookup(rel, uindex+1, lindex, true)
+			if err != nil {
+				return err
+			}
+			if len(chain) != 0 && !chain[0].covered && chain[0].tp != overlayTypeWhiteout {
+				base = &chain[0]
+			}
+		}
+		change := Change{Path: "/" + rel}
+
+		switch {
+		case utp == overlayTypeWhiteout:
+			if base == nil {
+				return nil
+			}
+			change.Kind = ChangeDeleted
+
+		case base == nil:
+			change.Kind = ChangeAdded
+
+		case utp == overlayTypeOpaque:
+			opaques = append(opaques, rel)
+			change.Kind = ChangeOpaque
+
+		default:
+			bpath := filepath.Join(fs.base, fs.layers[base.index], rel)
+			if change.Content, err = contentDiffers(upath, info, bpath, base.info); err != nil {
+				return err
+			}
+			if change.Mode, change.Owner, change.Xattrs, err = metadataDiffers(upath, info, bpath, base.info); err != nil {
+				return err
+			}
+			if !change.Content && !change.Mode && !change.Owner && !change.Xattrs {
+				return nil
+			}
+			change.Kind = ChangeModified
+		}
+
+		changes = append(changes, change)
+		return nil
+	})
+	return changes, err
+}
+
+// underAny returns whether the relative path is inside any of the directories.
+func underAny(relpath string, dirs []string) bool {
+	for _, dir := range dirs {
+		if strings.HasPrefix(relpath, dir+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+func contentDiffers(apath string, ainfo os.FileInfo, bpath string, binfo os.FileInfo) (bool, error) {
+	if ainfo.Mode().Type() != binfo.Mode().Type() {
+		return true, nil
+	}
+	switch {
+	case ainfo.Mode().IsRegular():
+		if ainfo.Size() != binfo.Size() {
+			return true, nil
+		}
+		same, err := sameFileContent(apath, bpath)
+		return !same, err
+	case ainfo.Mode()&os.ModeSymlink != 0:
+		alink, err := os.Readlink(apath)
+		if err != nil {
+			return false, err
+		}
+		blink, err := os.Readlink(bpath)
+		if err != nil {
+			return false, err
+		}
+		return alink != blink, nil
+	case ainfo.Mode()&os.ModeDevice != 0:
+		return ainfo.Sys().(*syscall.Stat_t).Rdev != binfo.Sys().(*syscall.Stat_t).Rdev, nil
+	}
+	return false, nil
+}
+
+func metadataDiffers(apath string, ainfo os.FileInfo, bpath string, binfo os.FileInfo) (mode, owner, xattrs bool, err error) {
+	const modeMask = os.ModePerm | os.ModeSetuid | os.ModeSetgid | os.ModeSticky
+	mode = ainfo.Mode()&modeMask != binfo.Mode()&modeMask
+
+	ast, bst := ainfo.Sys().(*syscall.Stat_t), binfo.Sys().(*syscall.Stat_t)
+	owner = ast.Uid != bst.Uid || ast.Gid != bst.Gid
+
+	axattrs, err := lxattrs(apath)
+	if err != nil {
+		return
+	}
+	bxattrs, err := lxattrs(bpath)
+	if err != nil {
+		return
+	}
+	for name := range axattrs {
+		if isOverlayXattr(name) {
+			delete(axattrs, name)
+		}
+	}
+	for name := range bxattrs {
+		if isOverlayXattr(name) {
+			delete(bxattrs, name)
+		}
+	}
+	if len(axattrs) != len(bxattrs) {
+		xattrs = true
+		return
+	}
+	for name, avalue := range axattrs {
+		if bvalue, ok := bxattrs[name]; !ok || !bytes.Equal(avalue, bvalue) {
+			xattrs = true
+			return
+		}
+	}
+	return
+}
+
+func sameFileContent(apath, bpath string) (bool, error) {
+	a, err := os.Open(apath)
+	if err != nil {
+		return false, err
+	}
+	defer a.Close()
+	b, err := os.Open(bpath)
+	if err != nil {
+		return false, err
+	}
+	defer b.Close()
+
+	const SIZE = 32 * 1024
+	abuf, bbuf := make([]byte, SIZE), make([]byte, SIZE)
+	for {
+		an, aerr := io.ReadFull(a, abuf)
+		bn, berr := io.ReadFull(b, bbuf)
+		if !bytes.Equal(abuf[:an], bbuf[:bn]) {
+			return false, nil
+		}
+		if aerr == io.EOF || aerr == io.ErrUnexpectedEOF {
+			return berr == io.EOF || berr == io.ErrUnexpectedEOF, nil
+		}
+		if aerr != nil {
+			return false, aerr
+		}
+		if berr != nil {
+			return false, nil
+		}
+	}
+}
@@ -0,0 +1,119 @@
+package ciel
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestDiff(t *testing.T) {
+	layers := Layers{"99-top", "60-upper", "30-lower", "00-bottom"}
+	tests := []struct {
+		name      string
+		files     map[string]testLayerFiles
+		userxattr bool
+		want      []string
+	}{
+		{
+			name:  "added",
+			files: map[string]testLayerFiles{"upper": {"dir/f"}},
+			want:  []string{"A /dir", "A /dir/f"},
+		},
+		{
+			name: "unchanged directory",
+			files: map[string]testLayerFiles{
+				"upper": {"etc/"},
+				"lower": {"etc/"},
+			},
+			want: nil,
+		},
+		{
+			name: "deleted",
+			files: map[string]testLayerFiles{
+				"upper":  {"f!", "g!"},
+				"bottom": {"f"},
+			},
+			want: []string{"D /f"},
+		},
+		{
+			name: "deleted under a deleted directory",
+			files: map[string]testLayerFiles{
+				"upper":  {"etc/f"},
+				"lower":  {"etc!"},
+				"bottom": {"etc/f"},
+			},
+			want: []string{"A /etc", "A /etc/f"},
+		},
+		{
+			name: "opaque directory",
+			files: map[string]testLayerFiles{
+				"upper":  {"etc/.", "etc/new", "etc/same"},
+				"lower":  {"etc/old", "etc/same"},
+				"bottom": {"etc/sub/deep"},
+			},
+			want: []string{"O /etc", "A /etc/new", "A /etc/same"},
+		},
+		{
+			name: "opaque directory, userxattr",
+			files: map[string]testLayerFiles{
+				"upper": {"etc/.", "etc/same"},
+				"lower": {"etc/same"},
+			},
+			userxattr: true,
+			want:      []string{"O /etc", "A /etc/same"},
+		},
+		{
+			name: "below an opaque directory of the lower layers",
+			files: map[string]testLayerFiles{
+				"upper":  {"etc/old"},
+				"lower":  {"etc/.", "etc/new"},
+				"bottom": {"etc/old"},
+			},
+			want: []string{"A /etc/old"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fs := newTestFileSystem(t, layers, tt.files, tt.userxattr)
+			changes, err := fs.Diff("upper", "bottom")
+			if err != nil {
+				t.Fatal("Diff:", err)
+			}
+			var got []string
+			for _, c := range changes {
+				got = append(got, c.String())
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Diff = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDiffModified(t *testing.T) {
+	fs := newTestFileSystem(t, Layers{"99-top", "60-upper", "00-bottom"}, map[string]testLayerFiles{
+		"upper":  {"content", "mode"},
+		"bottom": {"content", "mode"},
+	}, false)
+	upper := fs.Layer("upper")
+	if err := ioutil.WriteFile(filepath.Join(upper, "content"), []byte("changed"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chmod(filepath.Join(upper, "mode"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	changes, err := fs.Diff("upper", "bottom")
+	if err != nil {
+		t.Fatal("Diff:", err)
+	}
+	var b strings.Builder
+	if err := changes.WriteText(&b); err != nil {
+		t.Fatal(err)
+	}
+	if want := "M /content (content)\nM /mode (mode)\n"; b.String() != want {
+		t.Errorf("Diff = %q, want %q", b.String(), want)
+	}
+}
@@ -0,0 +1,250 @@
+package ciel
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+// ErrNoManifest is returned by Verify() when the layer has no stored manifest.
+var ErrNoManifest = errors.New("the layer has no manifest")
+
+// manifest maps every path in a layer to the digest of the path.
+type manifest map[string]string
+
+// Digest computes the digest of a layer, over paths, contents, modes,
+// ownership, extended attributes, whiteouts and opaque directories.
+// The digest is deterministic, eg. "sha256:0123...".
+func (fs *FileSystem) Digest(layer string) (string, error) {
+	m, err := fs.computeManifest(layer)
+	if err != nil {
+		return "", err
+	}
+	return m.digest(), nil
+}
+
+// WriteManifest computes the digest of every path in the layer, and stores
+// them beside the metadata of the layer, for Verify().
+// The digest of the layer is saved in the metadata, and returned.
+//
+// Once a layer has a manifest, it's updated when the layer is changed by
+// MergeFile() or other operations of FileSystem.
+func (fs *FileSystem) WriteManifest(layer string) (string, error) {
+	m, err := fs.computeManifest(layer)
+	if err != nil {
+		return "", err
+	}
+	if err := fs.writeManifest(layer, m); err != nil {
+		return "", err
+	}
+	meta, err := fs.LayerMeta(layer)
+	if err != nil {
+		return "", err
+	}
+	meta.Digest = m.digest()
+	return meta.Digest, fs.writeLayerMeta(meta)
+}
+
+// Verify compares the layer with its stored manifest, and returns the paths
+// which were changed, added or removed since WriteManifest().
+func (fs *FileSystem) Verify(layer string) ([]string, error) {
+	stored, err := fs.readManifest(layer)
+	if os.IsNotExist(err) {
+		return nil, ErrNoManifest
+	} else if err != nil {
+		return nil, err
+	}
+	current, err := fs.computeManifest(layer)
+	if err != nil {
+		return nil, err
+	}
+	var mismatched []string
+	for path, sum := range current {
+		if stored[path] != sum {
+			mismatched = append(mismatched, path)
+		}
+	}
+	for path := range stored {
+		if _, ok := current[path]; !ok {
+			mismatched = append(mismatched, path)
+		}
+	}
+	sort.Strings(mismatched)
+	return mismatched, nil
+}
+
+// digest is the digest of the whole manifest, in a deterministic format.
+func (m manifest) digest() string {
+	h := sha256.New()
+	m.writeTo(h)
+	return fmt.Sprintf("sha256:%x", h.Sum(nil))
+}
+
+func (m manifest) writeTo(w io.Writer) error {
+	paths := make([]string, 0, len(m))
+	for path := range m {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	for _, path := range paths {
+		if _, err := fmt.Fprintf(w, "%s %s\n", m[path], strconv.Quote(path)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (fs *FileSystem) manifestPath(layer string) string {
+	return filepath.Join(fs.base, LayerMetaDir, layer+".manifest")
+}
+
+func (fs *FileSystem) hasManifest(layer string) bool {
+	return exists(fs.manifestPath(layer))
+}
+
+func (fs *FileSystem) writeManifest(layer string, m manifest) error {
+	var buf bytes.Buffer
+	m.writeTo(&buf)
+	path := fs.manifestPath(layer)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(path+".tmp", buf.Bytes(), 0644); err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+func (fs *FileSystem) readManifest(layer string) (manifest, error) {
+	f, err := os.Open(fs.manifestPath(layer))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	m := make(manifest)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.SplitN(scanner.Text(), " ", 2)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("readManifest: broken line: %q", scanner.Text())
+		}
+		path, err := strconv.Unquote(fields[1])
+		if err != nil {
+			return nil, fmt.Errorf("readManifest: broken line: %q", scanner.Text())
+		}
+		m[path] = fields[0]
+	}
+	return m, scanner.Err()
+}
+
+// computeManifest walks the layer, and hashes the files in parallel.
+func (fs *FileSystem) computeManifest(layer string) (manifest, error) {
+	root := fs.Layer(layer)
+	type job struct {
+		path, rel string
+		info      os.FileInfo
+	}
+	var jobs []job
+	err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if os.IsNotExist(err) && path == root {
+			// the directory of a layer may not exist yet, like an empty one.
+			return nil
+		} else if err != nil {
+			return err
+		}
+		rel, _ := filepath.Rel(root, path)
+		jobs = append(jobs, job{path, filepath.Join("/", rel), info})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sums := make([]string, len(jobs))
+	errs := make([]error, len(jobs))
+	next := make(chan int)
+	var wg sync.WaitGroup
+	for n := 0; n < runtime.NumCPU(); n++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range next {
+				sums[i], errs[i] = entryDigest(jobs[i].path, jobs[i].rel, jobs[i].info)
+			}
+		}()
+	}
+	for i := range jobs {
+		next <- i
+	}
+	close(next)
+	wg.Wait()
+
+	m := make(manifest, len(jobs))
+	for i, j := range jobs {
+		if errs[i] != nil {
+			return nil, errs[i]
+		}
+		m[j.rel] = sums[i]
+	}
+	return m, nil
+}
+
+// entryDigest hashes a single path in a layer.
+func entryDigest(path, rel string, info os.FileInfo) (string, error) {
+	tp, err := overlayTypeOf(path, info, nil)
+	if err != nil {
+		return "", err
+	}
+	st := info.Sys().(*syscall.Stat_t)
+	h := sha256.New()
+	fmt.Fprintf(h, "%s\x00%s\x00%o\x00%d\x00%d\x00", rel, tp, st.Mode, st.Uid, st.Gid)
+
+	xattrs, err := lxattrs(path)
+	if err != nil {
+		return "", err
+	}
+	names := make([]string, 0, len(xattrs))
+	for name := range xattrs {
+		if !isOverlayXattr(name) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(h, "%s=%x\x00", name, xattrs[name])
+	}
+
+	switch {
+	case info.Mode().IsRegular():
+		f, err := os.Open(path)
+		if err != nil {
+			return "", err
+		}
+		_, err = io.Copy(h, f)
+		f.Close()
+		if err != nil {
+			return "", err
+		}
+	case info.Mode()&os.ModeSymlink != 0:
+		target, err := os.Readlink(path)
+		if err != nil {
+			return "", err
+		}
+		io.WriteString(h, target)
+	case info.Mode()&os.ModeDevice != 0:
+		fmt.Fprintf(h, "%d", st.Rdev)
+	}
+	return fmt.Sprintf("%x", h.Sum(nil)), nil
+}
@@ -0,0 +1,297 @@
+package ciel
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+// Whiteouts in OCI (and Docker) image layers are empty files with a prefix,
+// and an opaque directory contains an empty file with a special name.
+const (
+	ociWhiteoutPrefix = ".wh."
+	ociWhiteoutOpaque = ".wh..wh..opq"
+)
+
+// ExportLayer writes a layer to w as an OCI/Docker image layer in the format
+// (tar, optionally compressed). Whiteouts and opaque directories are converted
+// to ".wh." files. Extended attributes and hard links are preserved.
+func (fs *FileSystem) ExportLayer(name string, w io.Writer, format ArchiveFormat) error {
+	cw, err := compressWriter(w, format)
+	if err != nil {
+		return err
+	}
+	if err := checkSelfContained(fs.Layer(name)); err != nil {
+		cw.Close()
+		return err
+	}
+	e := newTarExporter(cw)
+	if e.shift, err = fs.OwnershipShift(name); err != nil {
+		cw.Close()
+		return err
+	}
+	root := fs.Layer(name)
+	err = filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if path == root {
+			return nil
+		}
+		rel, _ := filepath.Rel(root, path)
+		tp, err := overlayTypeOf(path, info, nil)
+		if err != nil {
+			return err
+		}
+		switch tp {
+		case overlayTypeWhiteout:
+			dir, base := filepath.Split(rel)
+			return e.writeEmpty(dir+ociWhiteoutPrefix+base, info)
+		case overlayTypeOpaque:
+			if err := e.writeFile(path, rel, info); err != nil {
+				return err
+			}
+			return e.writeEmpty(filepath.Join(rel, ociWhiteoutOpaque), info)
+		}
+		return e.writeFile(path, rel, info)
+	})
+	if err != nil {
+		cw.Close()
+		return err
+	}
+	if err := e.tw.Close(); err != nil {
+		cw.Close()
+		return err
+	}
+	return cw.Close()
+}
+
+// ExportRootfs writes the merged view of the enabled layers to w, as a tar
+// archive (optionally compressed) or a squashfs image. The output is
+// reproducible: entries are sorted, and if SOURCE_DATE_EPOCH is set in the
+// environment, modification times later than it are clamped to it.
+// It fails with ErrNotSelfContained if any enabled layer has metacopy or
+// redirect entries.
+func (fs *FileSystem) ExportRootfs(w io.Writer, format ArchiveFormat) error {
+	clamp, err := sourceDateEpoch()
+	if err != nil {
+		return err
+	}
+	fs.lock.RLock()
+	defer fs.lock.RUnlock()
+	for i := range fs.layers {
+		if i != 0 && !fs.layersMask[i] {
+			continue
+		}
+		if err := checkSelfContained(filepath.Join(fs.base, fs.layers[i])); err != nil {
+			return err
+		}
+	}
+	if format == FormatSquashfs {
+		return fs.exportSquashfs(w, clamp)
+	}
+	cw, err := compressWriter(w, format)
+	if err != nil {
+		return err
+	}
+	if err := fs.writeRootfs(cw, clamp); err != nil {
+		cw.Close()
+		return err
+	}
+	return cw.Close()
+}
+
+// writeRootfs writes the merged view as an uncompressed tar archive.
+func (fs *FileSystem) writeRootfs(w io.Writer, clamp time.Time) error {
+	e := newTarExporter(w)
+	e.clamp = clamp
+	shifts := make([]uint32, len(fs.layers))
+	for i, layer := range fs.layers {
+		var err error
+		if shifts[i], err = fs.OwnershipShift(layerName(layer)); err != nil {
+			return err
+		}
+	}
+	err := fs.walkMerged(0, len(fs.layers)-1, true, func(relpath string, le layerEntry) error {
+		path := filepath.Join(fs.base, fs.layers[le.index], relpath)
+		e.shift = shifts[le.index]
+		return e.writeFile(path, relpath, le.info)
+	})
+	if err != nil {
+		return err
+	}
+	return e.tw.Close()
+}
+
+// exportSquashfs pipes the tar archive to mksquashfs, and copies the image
+// to w. The image is built in the base directory, since it may be large.
+func (fs *FileSystem) exportSquashfs(w io.Writer, clamp time.Time) error {
+	tmp, err := ioutil.TempFile(fs.base, ".rootfs-*.squashfs")
+	if err != nil {
+		return err
+	}
+	tmp.Close()
+	defer os.Remove(tmp.Name())
+
+	var mkfsTime int64
+	if !clamp.IsZero() {
+		mkfsTime = clamp.Unix()
+	}
+	cmd := exec.Command(MksquashfsProc, "-", tmp.Name(), "-tar", "-noappend", "-quiet",
+		"-mkfs-time", strconv.FormatInt(mkfsTime, 10))
+	cmd.Stdout = os.Stderr
+	cmd.Stderr = os.Stderr
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return err
+	}
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	err = fs.writeRootfs(stdin, clamp)
+	stdin.Close()
+	if werr := cmd.Wait(); err == nil && werr != nil {
+		err = fmt.Errorf("%s: %v", MksquashfsProc, werr)
+	}
+	if err != nil {
+		return err
+	}
+	f, err := os.Open(tmp.Name())
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = io.Copy(w, f)
+	return err
+}
+
+// sourceDateEpoch returns the time in SOURCE_DATE_EPOCH, or zero if unset.
+// See https://reproducible-builds.org/specs/source-date-epoch/
+func sourceDateEpoch() (time.Time, error) {
+	s := os.Getenv("SOURCE_DATE_EPOCH")
+	if s == "" {
+		return time.Time{}, nil
+	}
+	sec, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid SOURCE_DATE_EPOCH: %q", s)
+	}
+	return time.Unix(sec, 0).UTC(), nil
+}
+
+// tarExporter writes files to a tar stream, keeping track of hard links.
+type tarExporter struct {
+	tw    *tar.Writer
+	links map[[2]uint64]string
+
+	// clamp is the latest modification time, if it's not zero.
+	clamp time.Time
+	// shift is the ownership shift of the files, see OwnershipShift().
+	// It's removed, so the archive is portable.
+	shift uint32
+}
+
+func newTarExporter(w io.Writer) *tarExporter {
+	return &tarExporter{
+		tw:    tar.NewWriter(w),
+		links: make(map[[2]uint64]string),
+	}
+}
+
+// writeFile writes the file at path as name in the archive.
+func (e *tarExporter) writeFile(path, name string, info os.FileInfo) error {
+	if info.Mode()&os.ModeSocket != 0 {
+		// tar can't hold sockets, they are created by running programs.
+		warnlog.Printf("export: skipping socket %q\n", name)
+		return nil
+	}
+	hdr, err := e.header(path, name, info)
+	if err != nil {
+		return err
+	}
+	if err := e.tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+	if hdr.Typeflag != tar.TypeReg {
+		return nil
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = io.Copy(e.tw, f)
+	return err
+}
+
+// header creates a deterministic header of the file: user and group names,
+// access time and change time are omitted.
+func (e *tarExporter) header(path, name string, info os.FileInfo) (*tar.Header, error) {
+	var link string
+	if info.Mode()&os.ModeSymlink != 0 {
+		var err error
+		if link, err = os.Readlink(path); err != nil {
+			return nil, err
+		}
+	}
+	hdr, err := tar.FileInfoHeader(info, link)
+	if err != nil {
+		return nil, err
+	}
+	hdr.Name = filepath.ToSlash(name)
+	if info.IsDir() {
+		hdr.Name += "/"
+	}
+	hdr.Uname, hdr.Gname = "", ""
+	hdr.AccessTime, hdr.ChangeTime = time.Time{}, time.Time{}
+	if !e.clamp.IsZero() && hdr.ModTime.After(e.clamp) {
+		hdr.ModTime = e.clamp
+	}
+	hdr.Uid = int(shiftID(uint32(hdr.Uid), e.shift, 0))
+	hdr.Gid = int(shiftID(uint32(hdr.Gid), e.shift, 0))
+	hdr.Format = tar.FormatPAX
+
+	st := info.Sys().(*syscall.Stat_t)
+	if info.Mode().IsRegular() && st.Nlink > 1 {
+		key := [2]uint64{uint64(st.Dev), st.Ino}
+		if first, ok := e.links[key]; ok {
+			hdr.Typeflag = tar.TypeLink
+			hdr.Linkname = first
+			hdr.Size = 0
+		} else {
+			e.links[key] = hdr.Name
+		}
+	}
+
+	xattrs, err := lxattrs(path)
+	if err != nil {
+		return nil, err
+	}
+	for xname, value := range xattrs {
+		if isOverlayXattr(xname) {
+			continue
+		}
+		if hdr.PAXRecords == nil {
+			hdr.PAXRecords = make(map[string]string)
+		}
+		hdr.PAXRecords["SCHILY.xattr."+xname] = string(value)
+	}
+	return hdr, nil
+}
+
+// writeEmpty writes an empty file, like a whiteout, with the time of info.
+func (e *tarExporter) writeEmpty(name string, info os.FileInfo) error {
+	return e.tw.WriteHeader(&tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     filepath.ToSlash(name),
+		ModTime:  info.ModTime(),
+		Format:   tar.FormatPAX,
+	})
+}
@@ -0,0 +1,122 @@
+package ciel
+
+import (
+	"archive/tar"
+	"bytes"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+var update = flag.Bool("update", false, "update the golden files in testdata")
+
+// dumpTar describes the entries of a tar archive, one per line.
+func dumpTar(t *testing.T, r io.Reader) string {
+	t.Helper()
+	var b strings.Builder
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		content, err := ioutil.ReadAll(tr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		fmt.Fprintf(&b, "%c %04o %d:%d %d %s", hdr.Typeflag, hdr.Mode, hdr.Uid, hdr.Gid, hdr.ModTime.Unix(), hdr.Name)
+		if hdr.Linkname != "" {
+			fmt.Fprintf(&b, " -> %s", hdr.Linkname)
+		}
+		if len(content) != 0 {
+			fmt.Fprintf(&b, " %q", content)
+		}
+		keys := make([]string, 0, len(hdr.PAXRecords))
+		for key := range hdr.PAXRecords {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			fmt.Fprintf(&b, " %s=%q", key, hdr.PAXRecords[key])
+		}
+		b.WriteString("\n")
+	}
+	return b.String()
+}
+
+// checkGolden compares got with the golden file testdata/name,
+// or updates it with "go test -update".
+func checkGolden(t *testing.T, name, got string) {
+	t.Helper()
+	path := filepath.Join("testdata", name)
+	if *update {
+		if err := ioutil.WriteFile(path, []byte(got), 0644); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+	want, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != string(want) {
+		t.Errorf("%s differs:\ngot:\n%s\nwant:\n%s", path, got, want)
+	}
+}
+
+// setTestTimes sets the modification time of everything in root to a fixed
+// time, so the archives are reproducible.
+func setTestTimes(t *testing.T, root string) {
+	t.Helper()
+	ts := syscall.Timespec{Sec: 1500000000}
+	var paths []string
+	err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		paths = append(paths, path)
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// directories after their contents.
+	for i := len(paths) - 1; i >= 0; i-- {
+		if err := lutimesNano(paths[i], ts, ts); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestExportLayer(t *testing.T) {
+	fs := newTestFileSystem(t, Layers{"99-top", "50-layer", "00-bottom"}, map[string]testLayerFiles{
+		"layer":  {"gone!", "etc/.", "etc/conf", "bin/a", "data", "run/"},
+		"bottom": {"gone", "etc/old"},
+	}, false)
+	root := fs.Layer("layer")
+	if err := os.Link(filepath.Join(root, "bin/a"), filepath.Join(root, "bin/b")); err != nil {
+		t.Fatal(err)
+	}
+	if err := lsetxattr(filepath.Join(root, "data"), "user.ciel.test", []byte("value"), 0); err != nil {
+		t.Skip("user xattr:", err)
+	}
+	if err := syscall.Mknod(filepath.Join(root, "run/sock"), syscall.S_IFSOCK|0755, 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("../bin/a", filepath.Join(root, "run/link")); err != nil {
+		t.Fatal(err)
+	}
+	setTestTimes(t, root)
+
+	var buf bytes.Buffer
+	if err := fs.ExportLayer("layer", &buf, FormatTar); err != nil {
+		t.Fatal("ExportLayer:", err)
+	}
+	checkGolden(t, "export_layer.golden", dumpTar(t, &buf))
+}
@@ -0,0 +1,361 @@
+package ciel
+
+import (
+	"archive/tar"
+	"crypto/sha256"
+	"crypto/sha512"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+// ErrChecksum is returned by ImportRootfs() when the archive does not
+// match the checksum.
+var ErrChecksum = errors.New("checksum mismatch")
+
+// ImportRootfs extracts a rootfs tarball, optionally compressed by gzip, zstd
+// or xz, into an empty layer. Devices, ownership, extended attributes and
+// hard links are preserved, and entries outside of the layer are rejected.
+//
+// If checksum is not empty, the archive is verified against it, eg.
+// "sha256:0123...", or a bare SHA-256 or SHA-512 hex digest.
+// The layer is cleared if the import fails.
+func (fs *FileSystem) ImportRootfs(layer string, r io.Reader, checksum string) error {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+	if err := fs.checkLayersChangeable(); err != nil {
+		return err
+	}
+	index := fs.layers.Index(layer)
+	h, want, err := parseChecksum(checksum)
+	if err != nil {
+		return err
+	}
+	root := filepath.Join(fs.base, fs.layers[index])
+	if err := os.MkdirAll(root, 0755); err != nil {
+		return err
+	}
+	if infos, err := ioutil.ReadDir(root); err != nil {
+		return err
+	} else if len(infos) != 0 {
+		return fmt.Errorf("ImportRootfs: layer %q is not empty", layer)
+	}
+
+	if h != nil {
+		r = io.TeeReader(r, h)
+	}
+	x := newTarExtractor(root)
+	x.rootless = fs.rootless
+	err = x.extractCompressed(r)
+	if err == nil && h != nil {
+		// the padding after the end of the archive is hashed too.
+		if _, err = io.Copy(ioutil.Discard, r); err == nil && fmt.Sprintf("%x", h.Sum(nil)) != want {
+			err = ErrChecksum
+		}
+	}
+	if err != nil {
+		errlog.Println("ImportRootfs:", err)
+		if cerr := clearDir(root, ".", nil); cerr != nil {
+			warnlog.Println("ImportRootfs:", cerr)
+		}
+		return err
+	}
+
+	if meta, err := fs.LayerMeta(layer); err == nil && meta.Created.IsZero() {
+		fs.createLayerMeta(index, "import-rootfs", "")
+	} else {
+		fs.touchLayerMeta(layer)
+	}
+	return nil
+}
+
+// parseChecksum returns the hash and the expected hex digest of a checksum.
+func parseChecksum(checksum string) (hash.Hash, string, error) {
+	if checksum == "" {
+		return nil, "", nil
+	}
+	algo, sum := "", strings.ToLower(checksum)
+	if fields := strings.SplitN(sum, ":", 2); len(fields) == 2 {
+		algo, sum = fields[0], fields[1]
+	}
+	switch {
+	case (algo == "" || algo == "sha256") && len(sum) == sha256.Size*2:
+		return sha256.New(), sum, nil
+	case (algo == "" || algo == "sha512") && len(sum) == sha512.Size*2:
+		return sha512.New(), sum, nil
+	}
+	return nil, "", fmt.Errorf("unsupported checksum: %q", checksum)
+}
+
+// tarExtractor extracts a tar stream into a directory safely: entries are
+// never written outside of the directory, nor through symbolic links.
+type tarExtractor struct {
+	root string
+
+	// oci makes ".wh." files whiteouts and opaque directories of overlayfs.
+	oci       bool
+	userxattr bool
+	// rootless extracts the files for the rootless mode, see
+	// FileSystem.SetRootless(): they are owned by the user, and devices,
+	// "trusted.*" and "security.*" extended attributes are skipped.
+	rootless bool
+
+	dirs []*dirTimes
+}
+
+// dirTimes is the times of a directory, which are set after all the entries
+// in it are extracted.
+type dirTimes struct {
+	path         string
+	atime, mtime syscall.Timespec
+}
+
+func newTarExtractor(root string) *tarExtractor {
+	return &tarExtractor{root: root}
+}
+
+// extract extracts all entries in r.
+func (x *tarExtractor) extract(r io.Reader) error {
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+		if err := x.extractEntry(tr, hdr); err != nil {
+			return fmt.Errorf("extract %q: %v", hdr.Name, err)
+		}
+	}
+	for i := len(x.dirs) - 1; i >= 0; i-- {
+		d := x.dirs[i]
+		if err := lutimesNano(d.path, d.atime, d.mtime); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// extractCompressed is extract(), but r may be compressed.
+func (x *tarExtractor) extractCompressed(r io.Reader) error {
+	dr, err := decompressReader(r)
+	if err != nil {
+		return err
+	}
+	if err := x.extract(dr); err != nil {
+		dr.Close()
+		return err
+	}
+	return dr.Close()
+}
+
+func (x *tarExtractor) extractEntry(tr *tar.Reader, hdr *tar.Header) error {
+	rel, err := cleanEntryName(hdr.Name)
+	if err != nil {
+		return err
+	}
+	dir, base := filepath.Split(rel)
+	if x.oci && strings.HasPrefix(base, ociWhiteoutPrefix) {
+		return x.extractWhiteout(dir, base)
+	}
+	if rel == "." {
+		if hdr.Typeflag != tar.TypeDir {
+			return fmt.Errorf("the root is not a directory")
+		}
+		return x.setAttrs(x.root, hdr)
+	}
+	if err := x.mkdirParents(dir); err != nil {
+		return err
+	}
+	path := filepath.Join(x.root, rel)
+
+	if info, err := os.Lstat(path); err == nil {
+		if info.IsDir() && hdr.Typeflag == tar.TypeDir {
+			return x.setAttrs(path, hdr)
+		}
+		if err := os.RemoveAll(path); err != nil {
+			return err
+		}
+	}
+
+	mode := uint32(hdr.Mode) & 07777
+	switch hdr.Typeflag {
+	case tar.TypeDir:
+		err = os.Mkdir(path, 0700)
+	case tar.TypeReg, tar.TypeRegA:
+		err = writeRegular(path, tr)
+	case tar.TypeSymlink:
+		err = os.Symlink(hdr.Linkname, path)
+	case tar.TypeLink:
+		target, e := cleanEntryName(hdr.Linkname)
+		if e != nil {
+			return e
+		}
+		if e := x.checkParents(filepath.Dir(target)); e != nil {
+			return e
+		}
+		// a hard link shares the attributes of its target.
+		return os.Link(filepath.Join(x.root, target), path)
+	case tar.TypeChar, tar.TypeBlock:
+		if x.rootless {
+			warnlog.Printf("extract: skipping device %q in the rootless mode\n", hdr.Name)
+			return nil
+		}
+		if hdr.Typeflag == tar.TypeChar {
+			err = syscall.Mknod(path, syscall.S_IFCHR|mode, mkdev(hdr.Devmajor, hdr.Devminor))
+		} else {
+			err = syscall.Mknod(path, syscall.S_IFBLK|mode, mkdev(hdr.Devmajor, hdr.Devminor))
+		}
+	case tar.TypeFifo:
+		err = syscall.Mkfifo(path, mode)
+	default:
+		warnlog.Printf("extract: skipping %q of unsupported type %q\n", hdr.Name, hdr.Typeflag)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return x.setAttrs(path, hdr)
+}
+
+// extractWhiteout converts a ".wh." file of OCI image layers.
+func (x *tarExtractor) extractWhiteout(dir, base string) error {
+	if base == ociWhiteoutOpaque {
+		if err := x.mkdirParents(dir); err != nil {
+			return err
+		}
+		return setOpaque(filepath.Join(x.root, dir), x.userxattr)
+	}
+	name := strings.TrimPrefix(base, ociWhiteoutPrefix)
+	// ".wh..." would remove the parent of the directory.
+	if name == "" || name == "." || name == ".." || strings.ContainsRune(name, filepath.Separator) {
+		return fmt.Errorf("invalid whiteout: %q", base)
+	}
+	if strings.HasPrefix(name, ociWhiteoutPrefix) {
+		// other ".wh..wh." files are internal files of AUFS.
+		return nil
+	}
+	if err := x.mkdirParents(dir); err != nil {
+		return err
+	}
+	path := filepath.Join(x.root, dir, name)
+	if err := os.RemoveAll(path); err != nil {
+		return err
+	}
+	return createWhiteout(path)
+}
+
+// setAttrs applies ownership, mode, extended attributes and times in hdr.
+func (x *tarExtractor) setAttrs(path string, hdr *tar.Header) error {
+	attrs := &fileAttrs{
+		Mode:    uint32(hdr.Mode) & 07777,
+		UID:     hdr.Uid,
+		GID:     hdr.Gid,
+		Mtime:   syscall.NsecToTimespec(hdr.ModTime.UnixNano()),
+		Xattrs:  make(map[string][]byte),
+		Symlink: hdr.Typeflag == tar.TypeSymlink,
+	}
+	attrs.Atime = attrs.Mtime
+	if !hdr.AccessTime.IsZero() {
+		attrs.Atime = syscall.NsecToTimespec(hdr.AccessTime.UnixNano())
+	}
+	if x.rootless {
+		// the files are owned by the user, see FileSystem.SetRootless().
+		attrs.UID, attrs.GID = os.Getuid(), os.Getgid()
+	}
+	for key, value := range hdr.PAXRecords {
+		name := strings.TrimPrefix(key, "SCHILY.xattr.")
+		if name == key || isOverlayXattr(name) {
+			continue
+		}
+		if x.rootless && (strings.HasPrefix(name, "trusted.") || strings.HasPrefix(name, "security.")) {
+			continue
+		}
+		attrs.Xattrs[name] = []byte(value)
+	}
+	if err := attrs.apply(path, false); err != nil {
+		return err
+	}
+	if hdr.Typeflag == tar.TypeDir {
+		x.dirs = append(x.dirs, &dirTimes{path, attrs.Atime, attrs.Mtime})
+	}
+	return nil
+}
+
+// mkdirParents creates the missing directories of dir in the root.
+func (x *tarExtractor) mkdirParents(dir string) error {
+	path := x.root
+	for _, name := range strings.Split(filepath.Clean(dir), string(filepath.Separator)) {
+		if name == "." || name == "" {
+			continue
+		}
+		path = filepath.Join(path, name)
+		info, err := os.Lstat(path)
+		if os.IsNotExist(err) {
+			if err := os.Mkdir(path, 0755); err != nil {
+				return err
+			}
+			continue
+		} else if err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			return fmt.Errorf("%q is not a directory", path)
+		}
+	}
+	return nil
+}
+
+// checkParents makes sure that dir in the root is not reached through
+// symbolic links.
+func (x *tarExtractor) checkParents(dir string) error {
+	path := x.root
+	for _, name := range strings.Split(filepath.Clean(dir), string(filepath.Separator)) {
+		if name == "." || name == "" {
+			continue
+		}
+		path = filepath.Join(path, name)
+		info, err := os.Lstat(path)
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			return fmt.Errorf("%q is not a directory", path)
+		}
+	}
+	return nil
+}
+
+// cleanEntryName returns the path of an entry relative to the root,
+// rejecting entries outside of it.
+func cleanEntryName(name string) (string, error) {
+	rel := filepath.Clean(strings.TrimLeft(filepath.FromSlash(name), string(filepath.Separator)))
+	if rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("path traversal in archive: %q", name)
+	}
+	return rel, nil
+}
+
+func writeRegular(path string, r io.Reader) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(f, r); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// mkdev encodes a device number like makedev(3).
+func mkdev(major, minor int64) int {
+	return int((major&0xfff)<<8 | (minor & 0xff) | (minor&^0xff)<<12 | (major&^0xfff)<<32)
+}
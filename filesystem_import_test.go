@@ -0,0 +1,244 @@
+package ciel
+
+import (
+	"archive/tar"
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// testTarEntry is an entry of a crafted archive. The type is a regular file
+// if it's not given.
+type testTarEntry struct {
+	name     string
+	typeflag byte
+	linkname string
+}
+
+func createTestTar(t *testing.T, entries []testTarEntry) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, e := range entries {
+		hdr := &tar.Header{Name: e.name, Typeflag: e.typeflag, Linkname: e.linkname, Mode: 0644}
+		var content []byte
+		switch e.typeflag {
+		case 0:
+			hdr.Typeflag = tar.TypeReg
+			content = []byte(e.name)
+		case tar.TypeDir:
+			hdr.Mode = 0755
+		}
+		hdr.Size = int64(len(content))
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write(content); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// snapshotTree describes everything in root, to find out what is changed.
+func snapshotTree(t *testing.T, root string) map[string]string {
+	t.Helper()
+	tree := make(map[string]string)
+	err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, _ := filepath.Rel(root, path)
+		desc := info.Mode().String()
+		switch {
+		case info.Mode().IsRegular():
+			b, err := ioutil.ReadFile(path)
+			if err != nil {
+				return err
+			}
+			desc += " " + string(b)
+		case info.Mode()&os.ModeSymlink != 0:
+			target, err := os.Readlink(path)
+			if err != nil {
+				return err
+			}
+			desc += " " + target
+		}
+		tree[rel] = desc
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tree
+}
+
+// unsafeTarEntries are archives which must be rejected, each of them trying
+// to change something outside of the layer.
+var unsafeTarEntries = []struct {
+	name    string
+	entries []testTarEntry
+}{
+	{"parent", []testTarEntry{{name: "../outside"}}},
+	{"absolute parent", []testTarEntry{{name: "/etc/../../outside"}}},
+	{"symlink parent", []testTarEntry{
+		{name: "link", typeflag: tar.TypeSymlink, linkname: ".."},
+		{name: "link/outside"},
+	}},
+	{"absolute symlink parent", []testTarEntry{
+		{name: "link", typeflag: tar.TypeSymlink, linkname: "/"},
+		{name: "link/outside"},
+	}},
+	{"hard link outside", []testTarEntry{{name: "f", typeflag: tar.TypeLink, linkname: "../outside"}}},
+	{"hard link through a symlink", []testTarEntry{
+		{name: "link", typeflag: tar.TypeSymlink, linkname: ".."},
+		{name: "f", typeflag: tar.TypeLink, linkname: "link/outside"},
+	}},
+}
+
+// unsafeWhiteouts are OCI layers with whiteouts which must be rejected.
+var unsafeWhiteouts = []struct {
+	name    string
+	entries []testTarEntry
+}{
+	{"whiteout parent", []testTarEntry{{name: ".wh..."}}},
+	{"whiteout self", []testTarEntry{{name: ".wh.."}}},
+	{"empty whiteout", []testTarEntry{{name: "etc/.wh."}}},
+	{"whiteout parent in a directory", []testTarEntry{{name: "etc/", typeflag: tar.TypeDir}, {name: "etc/.wh..."}}},
+	{"whiteout through a symlink", []testTarEntry{
+		{name: "link", typeflag: tar.TypeSymlink, linkname: ".."},
+		{name: "link/.wh.outside"},
+	}},
+}
+
+func TestImportRootfsUnsafe(t *testing.T) {
+	for _, tt := range unsafeTarEntries {
+		t.Run(tt.name, func(t *testing.T) {
+			fs := newTestFileSystem(t, Layers{"99-top", "50-layer", "00-bottom"}, map[string]testLayerFiles{
+				"top":    {"outside"},
+				"bottom": {"outside"},
+			}, false)
+			if err := ioutil.WriteFile(filepath.Join(fs.base, "outside"), []byte("outside"), 0644); err != nil {
+				t.Fatal(err)
+			}
+			before := snapshotTree(t, fs.base)
+			err := fs.ImportRootfs("layer", bytes.NewReader(createTestTar(t, tt.entries)), "")
+			if err == nil {
+				t.Error("ImportRootfs returned no error")
+			}
+			if after := snapshotTree(t, fs.base); !reflect.DeepEqual(before, after) {
+				t.Errorf("the base directory changed:\nbefore %v\nafter  %v", before, after)
+			}
+		})
+	}
+}
+
+// createTestOCILayout creates an OCI layout of an image with a layer.
+func createTestOCILayout(t *testing.T, dir string, layer []byte) {
+	t.Helper()
+	writeBlob := func(b []byte) ociDescriptor {
+		digest := fmt.Sprintf("%x", sha256.Sum256(b))
+		path := filepath.Join(dir, "blobs", "sha256", digest)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, b, 0644); err != nil {
+			t.Fatal(err)
+		}
+		return ociDescriptor{Digest: "sha256:" + digest, Size: int64(len(b))}
+	}
+	marshal := func(v interface{}) []byte {
+		b, err := json.Marshal(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return b
+	}
+	desc := writeBlob(layer)
+	desc.MediaType = "application/vnd.oci.image.layer.v1.tar"
+	manifest := writeBlob(marshal(ociManifest{Layers: []ociDescriptor{desc}}))
+	manifest.MediaType = "application/vnd.oci.image.manifest.v1+json"
+	index := marshal(ociIndex{Manifests: []ociDescriptor{manifest}})
+	if err := ioutil.WriteFile(filepath.Join(dir, "index.json"), index, 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestImportOCIUnsafe(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("needs root")
+	}
+	tests := append(unsafeTarEntries[:len(unsafeTarEntries):len(unsafeTarEntries)], unsafeWhiteouts...)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			root, err := ioutil.TempDir("", "ciel-test.")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(root)
+			layout, base := filepath.Join(root, "layout"), filepath.Join(root, "base")
+			createTestOCILayout(t, layout, createTestTar(t, tt.entries))
+			for _, dir := range []string{"00-other/etc", "00-other/outside"} {
+				if err := os.MkdirAll(filepath.Join(base, dir), 0755); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := ioutil.WriteFile(filepath.Join(base, "outside"), []byte("outside"), 0644); err != nil {
+				t.Fatal(err)
+			}
+			before := snapshotTree(t, root)
+			if _, err := ImportOCI(layout, "", base, false); err == nil {
+				t.Error("ImportOCI returned no error")
+			}
+			if after := snapshotTree(t, root); !reflect.DeepEqual(before, after) {
+				t.Errorf("the directories changed:\nbefore %v\nafter  %v", before, after)
+			}
+		})
+	}
+}
+
+func TestImportOCIWhiteouts(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("needs root")
+	}
+	root, err := ioutil.TempDir("", "ciel-test.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	layout, base := filepath.Join(root, "layout"), filepath.Join(root, "base")
+	createTestOCILayout(t, layout, createTestTar(t, []testTarEntry{
+		{name: "etc/", typeflag: tar.TypeDir},
+		{name: "etc/.wh.gone"},
+		{name: "etc/.wh..wh..opq"},
+		{name: "var/.wh..wh.aufs"},
+		{name: ".wh.bin"},
+	}))
+	layers, err := ImportOCI(layout, "", base, false)
+	if err != nil {
+		t.Fatal("ImportOCI:", err)
+	}
+	dir := filepath.Join(base, layers[1])
+	for _, p := range []string{"etc/gone", "bin"} {
+		info, err := os.Lstat(filepath.Join(dir, p))
+		if err != nil || !isWhiteout(info) {
+			t.Errorf("%s is not a whiteout: %v", p, err)
+		}
+	}
+	if !isOpaque(filepath.Join(dir, "etc")) {
+		t.Error("etc is not opaque")
+	}
+	// internal files of AUFS are skipped.
+	if _, err := os.Lstat(filepath.Join(dir, "var", ".wh.aufs")); !os.IsNotExist(err) {
+		t.Errorf("var/.wh.aufs exists: %v", err)
+	}
+}
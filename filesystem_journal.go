@@ -0,0 +1,301 @@
+package ciel
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"strconv"
+)
+
+// MergeJournalName is the name of the journal of the running merge,
+// and MergeTrashName is the name of the directory keeping removed files
+// until the merge is committed. Both are in the base directory, beside the layers.
+const (
+	MergeJournalName = ".merge.journal"
+	MergeTrashName   = ".merge.trash"
+)
+
+// MergeKeptName is the directory in the base directory keeping the journals
+// and the trash of the merges done by Squash(), until the result is verified.
+const MergeKeptName = ".merge.kept"
+
+// ErrMergePending is returned when a merge was interrupted, and it has not
+// been recovered by RecoverMerge() or ResumeMerge().
+var ErrMergePending = errors.New("an interrupted merge is pending, recover or resume it first")
+
+// journalRecord is a line in the journal. The first record is the header
+// describing the merge, the others are operations, written before they are
+// performed. Paths are relative to the base directory.
+type journalRecord struct {
+	// header
+	Upper       string `json:"upper,omitempty"`
+	Lower       string `json:"lower,omitempty"`
+	Path        string `json:"path,omitempty"`
+	ExcludeSelf bool   `json:"excludeSelf,omitempty"`
+
+	// operation
+	Op    MergeAction `json:"op,omitempty"`
+	Src   string      `json:"src,omitempty"`
+	Dst   string      `json:"dst,omitempty"`
+	Trash string      `json:"trash,omitempty"`
+	Attrs *fileAttrs  `json:"attrs,omitempty"`
+
+	// all operations are done, only the trash is left to clean.
+	Committed bool `json:"committed,omitempty"`
+}
+
+type mergeJournal struct {
+	fs     *FileSystem
+	file   *os.File
+	ntrash int
+}
+
+// HasPendingMerge returns whether a merge was interrupted.
+func (fs *FileSystem) HasPendingMerge() bool {
+	_, err := os.Lstat(fs.journalPath())
+	return err == nil
+}
+
+// RecoverMerge recovers the file system from an interrupted merge.
+// If all operations of the merge were done, it cleans up, otherwise it rolls
+// the merge back, leaving the layers as they were before the merge.
+// It fails with ErrMounted if the file system is mounted.
+func (fs *FileSystem) RecoverMerge() error {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+	if fs.mounted {
+		return ErrMounted
+	}
+	records, err := fs.readJournal()
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if isCommitted(records) {
+		return fs.cleanMerge()
+	}
+	return fs.rollbackMerge(records)
+}
+
+// ResumeMerge is RecoverMerge(), but it runs an uncommitted merge again
+// after rolling it back.
+func (fs *FileSystem) ResumeMerge() error {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+	if fs.mounted {
+		return ErrMounted
+	}
+	records, err := fs.readJournal()
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if isCommitted(records) {
+		return fs.cleanMerge()
+	}
+	if err := fs.rollbackMerge(records); err != nil {
+		return err
+	}
+	h := records[0]
+	_, err = fs.mergeFile(h.Path, h.Upper, h.Lower, h.ExcludeSelf)
+	return err
+}
+
+func (fs *FileSystem) journalPath() string {
+	return filepath.Join(fs.base, MergeJournalName)
+}
+
+func (fs *FileSystem) trashPath() string {
+	return filepath.Join(fs.base, MergeTrashName)
+}
+
+func beginJournal(fs *FileSystem, header journalRecord) (*mergeJournal, error) {
+	if fs.HasPendingMerge() {
+		return nil, ErrMergePending
+	}
+	if err := os.MkdirAll(fs.trashPath(), 0700); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(fs.journalPath(), os.O_WRONLY|os.O_CREATE|os.O_EXCL|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, err
+	}
+	j := &mergeJournal{fs: fs, file: f}
+	if err := j.log(header); err != nil {
+		f.Close()
+		os.Remove(fs.journalPath())
+		return nil, err
+	}
+	return j, nil
+}
+
+// log writes the record, and makes sure it's on the disk.
+func (j *mergeJournal) log(rec journalRecord) error {
+	rec.Src, rec.Dst, rec.Trash = j.rel(rec.Src), j.rel(rec.Dst), j.rel(rec.Trash)
+	b, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	if _, err := j.file.Write(append(b, '\n')); err != nil {
+		return err
+	}
+	return j.file.Sync()
+}
+
+// newTrash returns a new path in the trash.
+func (j *mergeJournal) newTrash() string {
+	j.ntrash++
+	return filepath.Join(j.fs.trashPath(), strconv.Itoa(j.ntrash))
+}
+
+func (j *mergeJournal) rel(path string) string {
+	if path == "" {
+		return ""
+	}
+	rel, _ := filepath.Rel(j.fs.base, path)
+	return rel
+}
+
+func (j *mergeJournal) commit() error {
+	if err := j.log(journalRecord{Committed: true}); err != nil {
+		return err
+	}
+	j.file.Close()
+	return j.fs.cleanMerge()
+}
+
+// keep moves the journal and the trash of a finished merge to dir, leaving
+// the merge uncommitted there.
+func (j *mergeJournal) keep(dir string) error {
+	j.file.Close()
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	if err := os.Rename(j.fs.trashPath(), filepath.Join(dir, MergeTrashName)); err != nil {
+		return err
+	}
+	return os.Rename(j.fs.journalPath(), filepath.Join(dir, MergeJournalName))
+}
+
+// rollbackKept rolls back the merges kept in dirs by mergeFileKept(), from
+// the last one. It must be called with the lock held.
+func (fs *FileSystem) rollbackKept(dirs []string) error {
+	for i := len(dirs) - 1; i >= 0; i-- {
+		if err := os.Rename(filepath.Join(dirs[i], MergeTrashName), fs.trashPath()); err != nil {
+			return err
+		}
+		if err := os.Rename(filepath.Join(dirs[i], MergeJournalName), fs.journalPath()); err != nil {
+			return err
+		}
+		records, err := fs.readJournal()
+		if err != nil {
+			return err
+		}
+		if err := fs.rollbackMerge(records); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (j *mergeJournal) rollback() error {
+	j.file.Close()
+	records, err := j.fs.readJournal()
+	if err != nil {
+		return err
+	}
+	return j.fs.rollbackMerge(records)
+}
+
+func (fs *FileSystem) readJournal() ([]journalRecord, error) {
+	f, err := os.Open(fs.journalPath())
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var records []journalRecord
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, 64*1024*1024)
+	for scanner.Scan() {
+		var rec journalRecord
+		if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+			// the last record may be incomplete, if the crash happened while writing it.
+			warnlog.Println("readJournal: ignoring broken record:", err)
+			break
+		}
+		records = append(records, rec)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(records) == 0 {
+		return nil, errors.New("readJournal: the journal has no header")
+	}
+	return records, nil
+}
+
+func isCommitted(records []journalRecord) bool {
+	return records[len(records)-1].Committed
+}
+
+// cleanMerge removes the trash and the journal of a committed merge.
+func (fs *FileSystem) cleanMerge() error {
+	if err := os.RemoveAll(fs.trashPath()); err != nil {
+		return err
+	}
+	return os.Remove(fs.journalPath())
+}
+
+// rollbackMerge undoes the operations in reverse order. Every undo can be
+// done more than once, so it can be retried if it fails halfway.
+// It must be called with the lock held.
+func (fs *FileSystem) rollbackMerge(records []journalRecord) error {
+	infolog.Println("rolling back merge:", records[0].Upper, "->", records[0].Lower)
+	abs := func(rel string) string {
+		return filepath.Join(fs.base, rel)
+	}
+	for i := len(records) - 1; i >= 1; i-- {
+		rec := records[i]
+		dbglog.Println("rollbackMerge:", rec.Op, rec.Src, rec.Dst)
+		src, dst := abs(rec.Src), abs(rec.Dst)
+		var err error
+		switch rec.Op {
+		case MergeMove, MergeCover:
+			if exists(dst) && !exists(src) {
+				err = os.Rename(dst, src)
+			}
+		case MergeRemove:
+			if trash := abs(rec.Trash); exists(trash) {
+				err = os.Rename(trash, dst)
+			}
+		case MergeCopyAttr, MergeClearOpaque:
+			if exists(dst) {
+				err = rec.Attrs.restore(dst)
+			}
+		case MergeOpenDir:
+			// the removed cover is restored later, it's not a directory.
+			if info, e := os.Lstat(dst); e == nil && info.IsDir() {
+				err = os.RemoveAll(dst)
+			}
+		case MergeMkdir:
+			if err = os.Remove(dst); os.IsNotExist(err) {
+				err = nil
+			}
+		}
+		if err != nil {
+			errlog.Println("rollbackMerge:", err)
+			return err
+		}
+	}
+	return fs.cleanMerge()
+}
+
+func exists(path string) bool {
+	_, err := os.Lstat(path)
+	return err == nil
+}
@@ -0,0 +1,187 @@
+package ciel
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"syscall"
+	"testing"
+)
+
+// testMergeLayers has a merge from "upper" to "lower" with every operation:
+// moves, removals, attributes, opaque and opened directories.
+var testMergeLayers = map[string]testLayerFiles{
+	"upper":  {"new/f", "file", "gone!", "etc/.", "etc/new", "dir/f", "cover/f", "attr/"},
+	"lower":  {"file", "gone", "etc/old", "dir/old", "cover!", "attr/f"},
+	"bottom": {"cover/old", "etc/older"},
+}
+
+func newTestMerge(t *testing.T) *FileSystem {
+	t.Helper()
+	fs := newTestFileSystem(t, Layers{"99-top", "60-upper", "30-lower", "00-bottom"}, testMergeLayers, false)
+	if err := os.Chmod(filepath.Join(fs.Layer("upper"), "attr"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	return fs
+}
+
+// layerTree describes everything in the layers, except the timestamps of
+// directories, which are changed by renaming files in them.
+func layerTree(t *testing.T, fs *FileSystem) map[string]string {
+	t.Helper()
+	tree := make(map[string]string)
+	for _, layer := range fs.layers {
+		root := filepath.Join(fs.base, layer)
+		err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+			rel, _ := filepath.Rel(fs.base, path)
+			if os.IsNotExist(err) && path == root {
+				// merging "/" removes the upper layer.
+				tree[rel] = "absent"
+				return nil
+			} else if err != nil {
+				return err
+			}
+			st := info.Sys().(*syscall.Stat_t)
+			desc := fmt.Sprintf("%o %d:%d %d", st.Mode, st.Uid, st.Gid, st.Rdev)
+			if !info.IsDir() {
+				desc += fmt.Sprintf(" %d.%09d", st.Mtim.Sec, st.Mtim.Nsec)
+			}
+			xattrs, err := lxattrs(path)
+			if err != nil {
+				return err
+			}
+			names := make([]string, 0, len(xattrs))
+			for name := range xattrs {
+				names = append(names, name)
+			}
+			sort.Strings(names)
+			for _, name := range names {
+				desc += fmt.Sprintf(" %s=%q", name, xattrs[name])
+			}
+			tree[rel] = desc
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	return tree
+}
+
+// interruptMerge runs a merge like mergeFile(), but it stops before
+// committing, like a crash. If broken is true, a half-written record is left
+// at the end of the journal.
+func interruptMerge(t *testing.T, fs *FileSystem, broken bool) {
+	t.Helper()
+	journal, err := beginJournal(fs, journalRecord{Upper: "upper", Lower: "lower", Path: "/", ExcludeSelf: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := &merger{fs: fs, upper: "upper", lower: "lower", journal: journal}
+	if err := m.merge("/", true); err != nil {
+		t.Fatal("merge:", err)
+	}
+	if broken {
+		if _, err := journal.file.WriteString(`{"op":"move","src":"60-up`); err != nil {
+			t.Fatal(err)
+		}
+	}
+	journal.file.Close()
+	if !fs.HasPendingMerge() {
+		t.Fatal("no pending merge")
+	}
+}
+
+func TestRecoverMerge(t *testing.T) {
+	for _, broken := range []bool{false, true} {
+		t.Run(fmt.Sprint("broken=", broken), func(t *testing.T) {
+			fs := newTestMerge(t)
+			before := layerTree(t, fs)
+			interruptMerge(t, fs, broken)
+			if reflect.DeepEqual(before, layerTree(t, fs)) {
+				t.Fatal("the merge changed nothing")
+			}
+			if err := fs.MergeFile("/", "upper", "lower", true); err != ErrMergePending {
+				t.Fatalf("MergeFile: %v, want %v", err, ErrMergePending)
+			}
+			if err := fs.RecoverMerge(); err != nil {
+				t.Fatal("RecoverMerge:", err)
+			}
+			if fs.HasPendingMerge() || exists(fs.trashPath()) {
+				t.Error("the journal or the trash is left")
+			}
+			if after := layerTree(t, fs); !reflect.DeepEqual(before, after) {
+				t.Errorf("the layers are not restored:\nbefore %v\nafter  %v", before, after)
+			}
+		})
+	}
+}
+
+func TestResumeMerge(t *testing.T) {
+	want := newTestMerge(t)
+	if err := want.MergeFile("/", "upper", "lower", true); err != nil {
+		t.Fatal("MergeFile:", err)
+	}
+	for _, broken := range []bool{false, true} {
+		t.Run(fmt.Sprint("broken=", broken), func(t *testing.T) {
+			fs := newTestMerge(t)
+			interruptMerge(t, fs, broken)
+			if err := fs.ResumeMerge(); err != nil {
+				t.Fatal("ResumeMerge:", err)
+			}
+			if fs.HasPendingMerge() || exists(fs.trashPath()) {
+				t.Error("the journal or the trash is left")
+			}
+			got, wantTree := mergedTree(t, fs), mergedTree(t, want)
+			if !reflect.DeepEqual(got, wantTree) {
+				t.Errorf("the resumed merge differs:\ngot  %v\nwant %v", got, wantTree)
+			}
+		})
+	}
+}
+
+// mergedTree is layerTree() without the timestamps, which differ between
+// the test file systems.
+func mergedTree(t *testing.T, fs *FileSystem) map[string]string {
+	t.Helper()
+	tree := make(map[string]string)
+	for _, layer := range []string{"upper", "lower", "bottom"} {
+		root := fs.Layer(layer)
+		err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+			rel, _ := filepath.Rel(root, path)
+			if os.IsNotExist(err) && path == root {
+				tree[layer] = "absent"
+				return nil
+			} else if err != nil {
+				return err
+			}
+			tree[layer+":"+rel] = fmt.Sprintf("%v %v", info.Mode(), isOpaque(path))
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	return tree
+}
+
+func TestRecoverMergeMounted(t *testing.T) {
+	fs := newTestMerge(t)
+	interruptMerge(t, fs, false)
+	fs.mounted = true
+	defer func() { fs.mounted = false }()
+	if err := fs.RecoverMerge(); err != ErrMounted {
+		t.Errorf("RecoverMerge: %v, want %v", err, ErrMounted)
+	}
+	if err := fs.ResumeMerge(); err != ErrMounted {
+		t.Errorf("ResumeMerge: %v, want %v", err, ErrMounted)
+	}
+	if _, err := fs.PlanMergeFile("/", "upper", "lower", true); err != ErrMounted {
+		t.Errorf("PlanMergeFile: %v, want %v", err, ErrMounted)
+	}
+	if !fs.HasPendingMerge() {
+		t.Error("the pending merge is gone")
+	}
+}
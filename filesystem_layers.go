@@ -0,0 +1,494 @@
+package ciel
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// ErrNoLayerNumber is returned when there is no number left between two
+// adjacent layers for a new layer.
+var ErrNoLayerNumber = errors.New("no free layer number between adjacent layers")
+
+// Commit turns the contents of the top layer into a new layer named name,
+// inserted directly below the top layer, and starts a fresh empty top layer.
+//
+// The new layer is numbered between the top layer and the layer below it,
+// eg. committing "build" with ["99-upper", "50-custom"] creates "75-build".
+// Layers may be renumbered if there is no free number between them.
+// The recorded ownership shift moves to the new layer, see OwnershipShift().
+func (fs *FileSystem) Commit(name string) error {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+	if fs.mounted {
+		return ErrMounted
+	}
+	if fs.HasPendingMerge() {
+		return ErrMergePending
+	}
+	if err := fs.checkNewLayerName(name); err != nil {
+		return err
+	}
+	if err := checkSelfContained(fs.TopLayer()); err != nil {
+		return err
+	}
+	fullname, err := fs.freeLayerNameAt(1, name)
+	if err != nil {
+		return err
+	}
+	meta, err := fs.LayerMeta(layerName(fs.layers[0]))
+	if err != nil {
+		return err
+	}
+
+	infolog.Println("commit", fs.layers[0], "->", fullname)
+	newdir := filepath.Join(fs.base, fullname)
+	if err := os.Rename(fs.TopLayer(), newdir); os.IsNotExist(err) {
+		err = os.Mkdir(newdir, 0755)
+		if err != nil {
+			return err
+		}
+	} else if err != nil {
+		return err
+	}
+	fs.insertLayer(1, fullname)
+	fs.createLayerMeta(1, "commit", "")
+	fs.setOwnershipShift(name, meta.Shift)
+
+	if err := os.RemoveAll(fs.TopLayerWorkDir()); err != nil {
+		return err
+	}
+	if err := os.Mkdir(fs.TopLayer(), 0755); err != nil {
+		return err
+	}
+	fs.setOwnershipShift(meta.Name, 0)
+	fs.touchLayerMeta(meta.Name)
+	return nil
+}
+
+// checkNewLayerName returns an error if the name can't be used by a new layer.
+func (fs *FileSystem) checkNewLayerName(name string) error {
+	if name == "" || strings.ContainsRune(name, filepath.Separator) || name == "." || name == ".." {
+		return fmt.Errorf("invalid layer name: %q", name)
+	}
+	if fs.layers.find(name) != -1 {
+		return fmt.Errorf("layer already exists: %q", name)
+	}
+	return nil
+}
+
+// layerNameAt returns the full name of a new layer, which will be inserted
+// at pos, between layers[pos-1] and layers[pos].
+func (fs *FileSystem) layerNameAt(pos int, name string) (string, error) {
+	upper, width, err := layerNumber(fs.layers[pos-1])
+	if err != nil {
+		return "", err
+	}
+	lower := -1
+	if pos < len(fs.layers) {
+		if lower, _, err = layerNumber(fs.layers[pos]); err != nil {
+			return "", err
+		}
+	}
+	if upper-lower < 2 {
+		return "", ErrNoLayerNumber
+	}
+	return fmt.Sprintf("%0*d-%s", width, (upper+lower+1)/2, name), nil
+}
+
+// insertLayer inserts a layer to the array at pos, which will be enabled.
+func (fs *FileSystem) insertLayer(pos int, fullname string) {
+	layers := make(Layers, 0, len(fs.layers)+1)
+	layers = append(layers, fs.layers[:pos]...)
+	layers = append(layers, fullname)
+	fs.layers = append(layers, fs.layers[pos:]...)
+
+	mask := make([]bool, 0, len(fs.layersMask)+1)
+	mask = append(mask, fs.layersMask[:pos]...)
+	mask = append(mask, true)
+	fs.layersMask = append(mask, fs.layersMask[pos:]...)
+}
+
+// layerNumber returns the number prefix of a layer, and the number of digits.
+//
+// Example: layerNumber("50-custom") returns 50, 2
+func layerNumber(fullname string) (num, width int, err error) {
+	fullnameSlice := strings.SplitN(fullname, "-", 2)
+	num, err = strconv.Atoi(fullnameSlice[0])
+	if err != nil || len(fullnameSlice) != 2 {
+		return 0, 0, fmt.Errorf("invalid layer: %q", fullname)
+	}
+	return num, len(fullnameSlice[0]), nil
+}
+
+// Reset discards everything in the top layer, except the paths to preserve,
+// and cleans the workdir. It fails with ErrMergePending if a merge has to be
+// recovered first. The recorded ownership shift is cleared, unless some paths
+// are preserved, which may still be shifted.
+func (fs *FileSystem) Reset(preserve ...string) error {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+	return fs.reset(preserve...)
+}
+
+// reset is Reset(), with the lock held.
+func (fs *FileSystem) reset(preserve ...string) error {
+	// a pending merge may restore files into the top layer.
+	if err := fs.checkLayersChangeable(); err != nil {
+		return err
+	}
+	keep := make(map[string]bool)
+	for _, p := range preserve {
+		keep[relPath(p)] = true
+	}
+	if err := os.RemoveAll(fs.TopLayerWorkDir()); err != nil {
+		return err
+	}
+	if keep["."] {
+		return nil
+	}
+	infolog.Println("reset", fs.layers[0])
+	if err := clearDir(fs.TopLayer(), ".", keep); err != nil {
+		return err
+	}
+	if len(keep) == 0 {
+		fs.setOwnershipShift(layerName(fs.layers[0]), 0)
+	}
+	fs.touchLayerMeta(layerName(fs.layers[0]))
+	return nil
+}
+
+// clearDir removes the contents of the directory relpath in root,
+// except the paths in keep, and their parent directories.
+func clearDir(root, relpath string, keep map[string]bool) error {
+	dir, err := os.Open(filepath.Join(root, relpath))
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	infos, err := dir.Readdir(0) // 0: check all sub-files
+	dir.Close()
+	if err != nil {
+		return err
+	}
+	for _, info := range infos {
+		rel := filepath.Join(relpath, info.Name())
+		if keep[rel] {
+			continue
+		}
+		if info.IsDir() && isParentOfAny(rel, keep) {
+			if err := clearDir(root, rel, keep); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := os.RemoveAll(filepath.Join(root, rel)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func isParentOfAny(relpath string, paths map[string]bool) bool {
+	for p := range paths {
+		if strings.HasPrefix(p, relpath+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// Squash flattens the layers from "from" down to "to" into a single layer
+// named newName, which takes the place (and the number) of "to".
+// Layers are merged one by one with MergeFile(), from top to bottom.
+// The top layer can't be squashed, use Commit() first.
+//
+// The layers in the range must be enabled. The merged view is compared before
+// and after merging, and if it's different, or a merge fails, the merges are
+// rolled back, from their journals and trash kept in MergeKeptName.
+func (fs *FileSystem) Squash(from, to, newName string) error {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+	if err := fs.checkLayersChangeable(); err != nil {
+		return err
+	}
+	findex, tindex := fs.layers.Index(from), fs.layers.Index(to)
+	if findex == 0 || findex >= tindex {
+		return errors.New("Squash: invalid range of layers")
+	}
+	for i := findex; i <= tindex; i++ {
+		if !fs.layersMask[i] {
+			return fmt.Errorf("Squash: layer %q is disabled", fs.layers[i])
+		}
+	}
+	if pos := fs.layers.find(newName); pos < findex || pos > tindex {
+		if err := fs.checkNewLayerName(newName); err != nil {
+			return err
+		}
+	}
+	num, width, err := layerNumber(fs.layers[tindex])
+	if err != nil {
+		return err
+	}
+	fullname := fmt.Sprintf("%0*d-%s", width, num, newName)
+
+	before, err := fs.viewSignature(findex)
+	if err != nil {
+		return err
+	}
+	kept := filepath.Join(fs.base, MergeKeptName)
+	if exists(kept) {
+		return fmt.Errorf("Squash: %s is left by an interrupted squash", kept)
+	}
+	defer func() {
+		if kept != "" {
+			os.RemoveAll(kept)
+		}
+	}()
+	var dirs []string
+	err = func() error {
+		for i := findex; i < tindex; i++ {
+			infolog.Println("squash", fs.layers[i], "->", fs.layers[i+1])
+			dir := filepath.Join(kept, strconv.Itoa(i))
+			if _, err := fs.mergeFileKept("/", layerName(fs.layers[i]), layerName(fs.layers[i+1]), true, dir); err != nil {
+				return err
+			}
+			dirs = append(dirs, dir)
+		}
+		// the merged layers are empty now, the view is the same without them.
+		after, err := fs.viewSignature(findex)
+		if err != nil {
+			return err
+		}
+		for path, sig := range before {
+			if after[path] != sig {
+				return fmt.Errorf("Squash: merged view changed at %s", path)
+			}
+		}
+		for path := range after {
+			if _, ok := before[path]; !ok {
+				return fmt.Errorf("Squash: merged view changed at %s", path)
+			}
+		}
+		return nil
+	}()
+	if err != nil {
+		errlog.Println(err)
+		if rerr := fs.rollbackKept(dirs); rerr != nil {
+			errlog.Println("Squash: rollback failed, the merges are kept in", kept, rerr)
+			// keep them for inspection.
+			kept = ""
+		}
+		for i := findex; i <= tindex; i++ {
+			fs.touchLayerMeta(layerName(fs.layers[i]))
+		}
+		return err
+	}
+
+	if err := os.Rename(filepath.Join(fs.base, fs.layers[tindex]), filepath.Join(fs.base, fullname)); err != nil {
+		return err
+	}
+	squashed := make([]string, 0, tindex-findex+1)
+	for _, fullname := range fs.layers[findex : tindex+1] {
+		squashed = append(squashed, layerName(fullname))
+		fs.removeLayerMeta(layerName(fullname))
+	}
+	fs.layers = append(append(Layers{}, fs.layers[:findex]...), append(Layers{fullname}, fs.layers[tindex+1:]...)...)
+	fs.layersMask = append(append([]bool{}, fs.layersMask[:findex]...), append([]bool{true}, fs.layersMask[tindex+1:]...)...)
+	fs.createLayerMeta(findex, "squash", "squashed from "+strings.Join(squashed, ", "))
+	return nil
+}
+
+// viewSignature describes every path in the merged view of all layers
+// from lbound to the bottom. Timestamps of directories are ignored,
+// they are changed by merging.
+func (fs *FileSystem) viewSignature(lbound int) (map[string]string, error) {
+	sigs := make(map[string]string)
+	err := fs.walkMerged(lbound, len(fs.layers)-1, false, func(relpath string, e layerEntry) error {
+		path := filepath.Join(fs.base, fs.layers[e.index], relpath)
+		st := e.info.Sys().(*syscall.Stat_t)
+		sig := fmt.Sprintf("%o %d:%d", st.Mode, st.Uid, st.Gid)
+		if !e.info.IsDir() {
+			sig += fmt.Sprintf(" %d %d %d.%09d", st.Size, st.Rdev, st.Mtim.Sec, st.Mtim.Nsec)
+		}
+		if e.info.Mode()&os.ModeSymlink != 0 {
+			target, err := os.Readlink(path)
+			if err != nil {
+				return err
+			}
+			sig += " -> " + target
+		}
+		xattrs, err := lxattrs(path)
+		if err != nil {
+			return err
+		}
+		names := make([]string, 0, len(xattrs))
+		for name := range xattrs {
+			if !isOverlayXattr(name) {
+				names = append(names, name)
+			}
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			sig += fmt.Sprintf(" %s=%x", name, xattrs[name])
+		}
+		sigs[relpath] = sig
+		return nil
+	})
+	return sigs, err
+}
+
+// InsertLayer creates a new empty layer named name at pos of the layers,
+// where 1 is directly below the top layer, and len(layers) is the bottom.
+// Layers may be renumbered if there is no free number between the neighbors.
+func (fs *FileSystem) InsertLayer(name string, pos int) error {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+	if err := fs.checkLayersChangeable(); err != nil {
+		return err
+	}
+	if err := fs.checkNewLayerName(name); err != nil {
+		return err
+	}
+	if pos < 1 || pos > len(fs.layers) {
+		return fmt.Errorf("InsertLayer: invalid position %d", pos)
+	}
+	fullname, err := fs.freeLayerNameAt(pos, name)
+	if err != nil {
+		return err
+	}
+	infolog.Println("insert layer", fullname)
+	if err := os.Mkdir(filepath.Join(fs.base, fullname), 0755); err != nil {
+		return err
+	}
+	fs.insertLayer(pos, fullname)
+	fs.createLayerMeta(pos, "insert", "")
+	return nil
+}
+
+// RemoveLayer removes a layer from the file system, and deletes its directory.
+// The top layer can't be removed.
+func (fs *FileSystem) RemoveLayer(name string) error {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+	if err := fs.checkLayersChangeable(); err != nil {
+		return err
+	}
+	index := fs.layers.Index(name)
+	if index == 0 {
+		return errors.New("RemoveLayer: the top layer can't be removed")
+	}
+	infolog.Println("remove layer", fs.layers[index])
+	if err := os.RemoveAll(filepath.Join(fs.base, fs.layers[index])); err != nil {
+		return err
+	}
+	fs.removeLayer(index)
+	fs.removeLayerMeta(name)
+	return nil
+}
+
+// MoveLayer moves a layer to pos of the layers, like InsertLayer().
+// The position is counted without the layer itself. The top layer can't be moved.
+func (fs *FileSystem) MoveLayer(name string, pos int) error {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+	if err := fs.checkLayersChangeable(); err != nil {
+		return err
+	}
+	index := fs.layers.Index(name)
+	if index == 0 {
+		return errors.New("MoveLayer: the top layer can't be moved")
+	}
+	if pos < 1 || pos > len(fs.layers)-1 {
+		return fmt.Errorf("MoveLayer: invalid position %d", pos)
+	}
+	oldname, enabled := fs.layers[index], fs.layersMask[index]
+	fs.removeLayer(index)
+	newname, err := fs.freeLayerNameAt(pos, name)
+	if err == nil {
+		infolog.Println("move layer", oldname, "->", newname)
+		err = os.Rename(filepath.Join(fs.base, oldname), filepath.Join(fs.base, newname))
+	}
+	if err != nil {
+		fs.insertLayer(index, oldname)
+		fs.layersMask[index] = enabled
+		return err
+	}
+	fs.insertLayer(pos, newname)
+	fs.layersMask[pos] = enabled
+	return nil
+}
+
+// checkLayersChangeable returns an error if the layers can't be changed now.
+func (fs *FileSystem) checkLayersChangeable() error {
+	if fs.mounted {
+		return ErrMounted
+	}
+	if fs.HasPendingMerge() {
+		return ErrMergePending
+	}
+	return nil
+}
+
+// freeLayerNameAt is layerNameAt(), but it renumbers all layers if there
+// is no free number.
+func (fs *FileSystem) freeLayerNameAt(pos int, name string) (string, error) {
+	fullname, err := fs.layerNameAt(pos, name)
+	if err != ErrNoLayerNumber {
+		return fullname, err
+	}
+	if err := fs.renumberLayers(len(fs.layers) + 1); err != nil {
+		return "", err
+	}
+	return fs.layerNameAt(pos, name)
+}
+
+// renumberLayers spreads the numbers of layers evenly, leaving room for n
+// layers in total, and renames their directories. The number of digits grows
+// if there are not enough numbers.
+func (fs *FileSystem) renumberLayers(n int) error {
+	_, width, err := layerNumber(fs.layers[0])
+	if err != nil {
+		return err
+	}
+	max := 1
+	for i := 0; i < width; i++ {
+		max *= 10
+	}
+	for (max-1)/n < 2 {
+		max *= 10
+		width++
+	}
+	step := (max - 1) / n
+	for i, fullname := range fs.layers {
+		newname := fmt.Sprintf("%0*d-%s", width, max-1-i*step, layerName(fullname))
+		if newname == fullname {
+			continue
+		}
+		infolog.Println("renumber layer", fullname, "->", newname)
+		if err := os.Rename(filepath.Join(fs.base, fullname), filepath.Join(fs.base, newname)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		if i == 0 {
+			// the workdir follows the top layer.
+			err := os.Rename(filepath.Join(fs.base, fullname+WorkDirSuffix), filepath.Join(fs.base, newname+WorkDirSuffix))
+			if err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+		fs.layers[i] = newname
+	}
+	return nil
+}
+
+// removeLayer removes a layer from the array.
+func (fs *FileSystem) removeLayer(pos int) {
+	fs.layers = append(append(Layers{}, fs.layers[:pos]...), fs.layers[pos+1:]...)
+	fs.layersMask = append(append([]bool{}, fs.layersMask[:pos]...), fs.layersMask[pos+1:]...)
+}
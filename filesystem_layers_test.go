@@ -0,0 +1,93 @@
+package ciel
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestSquash(t *testing.T) {
+	fs := newTestMerge(t)
+	before, err := fs.viewSignature(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.Squash("upper", "lower", "squashed"); err != nil {
+		t.Fatal("Squash:", err)
+	}
+	if want := (Layers{"99-top", "30-squashed", "00-bottom"}); !reflect.DeepEqual(fs.layers, want) {
+		t.Errorf("layers: %v, want %v", fs.layers, want)
+	}
+	after, err := fs.viewSignature(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(before, after) {
+		t.Errorf("the merged view changed:\nbefore %v\nafter  %v", before, after)
+	}
+	if exists(filepath.Join(fs.base, MergeKeptName)) || fs.HasPendingMerge() {
+		t.Error("the kept merges are left")
+	}
+}
+
+func TestSquashDisabled(t *testing.T) {
+	fs := newTestMerge(t)
+	before := layerTree(t, fs)
+	fs.DisableLayer("upper")
+	if err := fs.Squash("upper", "lower", "squashed"); err == nil || !strings.Contains(err.Error(), "disabled") {
+		t.Errorf("Squash: %v, want the disabled layer refused", err)
+	}
+	if after := layerTree(t, fs); !reflect.DeepEqual(before, after) {
+		t.Errorf("the layers changed:\nbefore %v\nafter  %v", before, after)
+	}
+}
+
+func TestRollbackKept(t *testing.T) {
+	fs := newTestMerge(t)
+	before := layerTree(t, fs)
+	kept := filepath.Join(fs.base, MergeKeptName)
+	var dirs []string
+	for i, m := range [][2]string{{"upper", "lower"}, {"lower", "bottom"}} {
+		dir := filepath.Join(kept, strconv.Itoa(i))
+		if _, err := fs.mergeFileKept("/", m[0], m[1], true, dir); err != nil {
+			t.Fatal("mergeFileKept:", err)
+		}
+		dirs = append(dirs, dir)
+	}
+	if fs.HasPendingMerge() {
+		t.Fatal("the kept merge is pending")
+	}
+	if err := fs.rollbackKept(dirs); err != nil {
+		t.Fatal("rollbackKept:", err)
+	}
+	if fs.HasPendingMerge() || exists(fs.trashPath()) {
+		t.Error("the journal or the trash is left")
+	}
+	if after := layerTree(t, fs); !reflect.DeepEqual(before, after) {
+		t.Errorf("the layers are not restored:\nbefore %v\nafter  %v", before, after)
+	}
+	os.RemoveAll(kept)
+}
+
+func TestResetWorkDir(t *testing.T) {
+	for _, preserve := range [][]string{nil, {"/"}, {"/f", "/"}} {
+		fs := newTestFileSystem(t, Layers{"99-top", "00-bottom"}, map[string]testLayerFiles{
+			"top": {"f"},
+		}, false)
+		if err := os.MkdirAll(filepath.Join(fs.TopLayerWorkDir(), "work"), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := fs.Reset(preserve...); err != nil {
+			t.Fatalf("Reset(%q): %v", preserve, err)
+		}
+		if exists(fs.TopLayerWorkDir()) {
+			t.Errorf("Reset(%q) left the workdir", preserve)
+		}
+		if exists(filepath.Join(fs.TopLayer(), "f")) != (len(preserve) != 0) {
+			t.Errorf("Reset(%q) did not preserve the top layer", preserve)
+		}
+	}
+}
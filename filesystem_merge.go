@@ -1,24 +1,185 @@
 package ciel
 
 import (
+	"encoding/json"
+	"fmt"
+	"io"
 	"os"
-	"os/exec"
 	"path/filepath"
-	"strings"
 	"syscall"
 )
 
+// MergeAction is the kind of an operation performed by MergeFile().
+type MergeAction string
+
+const (
+	MergeMkdir       MergeAction = "mkdir"        // create a missing parent directory
+	MergeMove        MergeAction = "move"         // move a file or directory from the upper layer
+	MergeCover       MergeAction = "cover"        // move a whiteout from the upper layer, covering lower layers
+	MergeRemove      MergeAction = "remove"       // remove a file or directory
+	MergeCopyAttr    MergeAction = "copy-attr"    // copy attributes of a directory from the upper layer
+	MergeOpenDir     MergeAction = "open"         // create an opaque directory, with attributes from the upper layer
+	MergeClearOpaque MergeAction = "clear-opaque" // turn an opaque directory into a normal one
+)
+
+// MergeOp is an operation on a path of a layer, performed by MergeFile().
+type MergeOp struct {
+	Action MergeAction `json:"action"`
+	Path   string      `json:"path"`
+	Layer  string      `json:"layer"`
+}
+
+// String formats the operation like "move bottom:/usr/bin/foo".
+func (op MergeOp) String() string {
+	return fmt.Sprintf("%s %s:%s", op.Action, op.Layer, op.Path)
+}
+
+// MergeReport is the list of operations of a merge, in order.
+type MergeReport []MergeOp
+
+// WriteText writes the operations line by line.
+func (r MergeReport) WriteText(w io.Writer) error {
+	for _, op := range r {
+		if _, err := fmt.Fprintln(w, op.String()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// WriteJSON writes the operations as a JSON array.
+func (r MergeReport) WriteJSON(w io.Writer) error {
+	if r == nil {
+		r = MergeReport{}
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(r)
+}
+
 // MergeFile is the method to merge a file or directory from an upper layer
 // to a lower layer.
+//
+// The merge is all-or-nothing: every operation is written to a journal beside
+// the layers before it is performed, and if any operation fails, the merge will
+// be rolled back. If the process crashed halfway, the next merge will fail
+// with ErrMergePending, until RecoverMerge() or ResumeMerge() is called.
+//
+// If the ownership of the layers is shifted differently by a container with
+// PrivateUsers, it fails with ErrOwnershipShifted, see ShiftOwnership().
 func (fs *FileSystem) MergeFile(path, upper, lower string, excludeSelf bool) error {
-	if fs.IsMounted() {
+	_, err := fs.MergeFileReport(path, upper, lower, excludeSelf)
+	return err
+}
+
+// MergeFileReport is MergeFile(), but it also returns the operations done.
+// If the merge failed, they have been rolled back.
+func (fs *FileSystem) MergeFileReport(path, upper, lower string, excludeSelf bool) (MergeReport, error) {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+	if fs.mounted {
 		errlog.Panicln("MergeFile: cannot merge the underlying file system when it has been mounted")
 	}
+	return fs.mergeFile(path, upper, lower, excludeSelf)
+}
+
+// mergeFile is MergeFileReport(), with the lock held.
+func (fs *FileSystem) mergeFile(path, upper, lower string, excludeSelf bool) (MergeReport, error) {
+	return fs.mergeFileKept(path, upper, lower, excludeSelf, "")
+}
+
+// mergeFileKept is mergeFile(), but if keep is not empty, the journal and the
+// trash are moved to the directory keep when the merge is done, instead of
+// being cleaned, so it can be rolled back later by rollbackKept().
+func (fs *FileSystem) mergeFileKept(path, upper, lower string, excludeSelf bool, keep string) (MergeReport, error) {
+	if err := fs.checkSameShift(upper, lower); err != nil {
+		return nil, err
+	}
+	if err := checkSelfContained(filepath.Join(fs.Layer(upper), path)); err != nil {
+		return nil, err
+	}
+	journal, err := beginJournal(fs, journalRecord{
+		Upper:       upper,
+		Lower:       lower,
+		Path:        path,
+		ExcludeSelf: excludeSelf,
+	})
+	if err != nil {
+		return nil, err
+	}
+	m := &merger{fs: fs, upper: upper, lower: lower, journal: journal}
+	if err := m.merge(path, excludeSelf); err != nil {
+		errlog.Println("MergeFile:", err)
+		if rerr := journal.rollback(); rerr != nil {
+			errlog.Println("MergeFile: rollback failed:", rerr)
+		}
+		return m.report, err
+	}
+	if keep != "" {
+		err = journal.keep(keep)
+	} else {
+		err = journal.commit()
+	}
+	if err != nil {
+		return m.report, err
+	}
+	fs.touchLayerMeta(upper)
+	fs.touchLayerMeta(lower)
+	return m.report, nil
+}
+
+// PlanMergeFile returns the operations MergeFile() would perform,
+// without changing anything. It fails with ErrMounted if the file system
+// is mounted, since the layers may change under it.
+func (fs *FileSystem) PlanMergeFile(path, upper, lower string, excludeSelf bool) (MergeReport, error) {
+	fs.lock.RLock()
+	defer fs.lock.RUnlock()
+	if fs.mounted {
+		return nil, ErrMounted
+	}
+	if err := fs.checkSameShift(upper, lower); err != nil {
+		return nil, err
+	}
+	if err := checkSelfContained(filepath.Join(fs.Layer(upper), path)); err != nil {
+		return nil, err
+	}
+	m := &merger{fs: fs, upper: upper, lower: lower, dryRun: true, opened: make(map[string]bool)}
+	err := m.merge(path, excludeSelf)
+	return m.report, err
+}
+
+// merger performs a merge, and records the operations.
+type merger struct {
+	fs           *FileSystem
+	upper, lower string
+
+	journal *mergeJournal
+	report  MergeReport
+
+	dryRun bool
+	// opened directories in a dry-run, which would be empty
+	opened map[string]bool
+
+	// root is the path to merge in the upper layer, and rootMoved is true
+	// if it has been moved, so it's not removed at the end.
+	root      string
+	rootMoved bool
+}
+
+func (m *merger) merge(path string, excludeSelf bool) error {
+	fs := m.fs
 	path = filepath.Clean(path)
-	uroot, lroot := fs.Layer(upper), fs.Layer(lower)
-	lindex, maxindex := fs.layers.Index(lower), len(fs.layers)-1
+	uroot, lroot := fs.Layer(m.upper), fs.Layer(m.lower)
+	lindex, maxindex := fs.layers.Index(m.lower), len(fs.layers)-1
 	walkBase := filepath.Join(uroot, path)
-	os.MkdirAll(filepath.Dir(filepath.Join(lroot, path)), 755)
+	m.root = walkBase
+	for _, p := range parentPaths(relPath(path)) {
+		if lp := filepath.Join(lroot, p); !exists(lp) {
+			if err := m.mkdir(p, lp); err != nil {
+				return err
+			}
+		}
+	}
 	err := filepath.Walk(walkBase, func(upath string, info os.FileInfo, err error) error {
 		if excludeSelf && upath == walkBase {
 			return nil
@@ -26,11 +187,11 @@ func (fs *FileSystem) MergeFile(path, upper, lower string, excludeSelf bool) err
 		rel, _ := filepath.Rel(uroot, upath)
 		lpath := filepath.Join(lroot, rel)
 
-		utp, err := overlayTypeByInfo(info, err)
+		utp, err := overlayTypeOf(upath, info, err)
 		if err != nil {
 			return err
 		}
-		ltp, err := overlayTypeByLstat(lpath)
+		ltp, err := m.lowerType(rel, lpath)
 		if err != nil {
 			return err
 		}
@@ -38,19 +199,39 @@ func (fs *FileSystem) MergeFile(path, upper, lower string, excludeSelf bool) err
 		switch utp {
 		case overlayTypeAir:
 			return filepath.SkipDir
+		case overlayTypeOpaque:
+			// the upper layer replaced the whole directory,
+			// nothing in the lower layer should survive.
+			if ltp != overlayTypeAir {
+				if err := m.remove(rel, lpath); err != nil {
+					return err
+				}
+			}
+			if err := m.move(MergeMove, rel, upath, lpath); err != nil {
+				return err
+			}
+
+			// nothing to hide under the bottom.
+			if lindex == maxindex {
+				if err := m.clearOpaque(rel, lpath); err != nil {
+					return err
+				}
+			}
+			return filepath.SkipDir
+
 		case overlayTypeDir:
 
 			switch ltp {
 			case overlayTypeAir:
 				// the lower layer had no effect on this position.
-				if err := os.Rename(upath, lpath); err != nil {
+				if err := m.move(MergeMove, rel, upath, lpath); err != nil {
 					return err
 				}
 				return filepath.SkipDir
 
-			case overlayTypeDir:
+			case overlayTypeDir, overlayTypeOpaque:
 				// copy attributes, and continue.
-				return copyAttributes(upath, lpath)
+				return m.copyAttributes(rel, upath, lpath)
 
 			default:
 				// the upper layer is a directory,
@@ -60,48 +241,174 @@ func (fs *FileSystem) MergeFile(path, upper, lower string, excludeSelf bool) err
 				// if the lower layer is at the bottom
 				// or lower layers under the lower layer have another cover,
 				// we can merge the upper one safely.
-				nextfilelayer, havedir := fs.nextLayerHasFile(rel, lindex)
-				if !havedir {
-					os.Remove(lpath)
-					if err := os.Rename(upath, lpath); err != nil {
+				if err := m.remove(rel, lpath); err != nil {
+					return err
+				}
+				if !fs.nextLayerHasDir(rel, lindex) {
+					if err := m.move(MergeMove, rel, upath, lpath); err != nil {
 						return err
 					}
 					return filepath.SkipDir
 				}
 
-				// 1). "open" the directory
-				os.Mkdir(lpath, 0000)
-				if err := copyAttributes(upath, lpath); err != nil {
-					return err
-				}
-				// 2). "cover" all sub-files in the directory
-				for filename := range fs.readDirInRange(rel, lindex+1, nextfilelayer-1) {
-					createWhiteout(filepath.Join(lpath, filename))
-				}
-				return nil
+				// "open" the directory, make it opaque
+				// to "cover" all sub-files in lower layers.
+				return m.openDir(rel, upath, lpath)
 			}
 
 		default:
 			// the upper layer is a whiteout or a normal file, which acts as a cover.
-			os.RemoveAll(lpath)
-			err := os.Rename(upath, lpath)
+			if ltp != overlayTypeAir {
+				if err := m.remove(rel, lpath); err != nil {
+					return err
+				}
+			}
 
 			// a whiteout applied to the bottom?
-			if lindex == maxindex && utp == overlayTypeWhiteout {
-				os.Remove(lpath)
+			if utp == overlayTypeWhiteout {
+				if lindex == maxindex {
+					return nil
+				}
+				return m.move(MergeCover, rel, upath, lpath)
 			}
-
-			return err
+			return m.move(MergeMove, rel, upath, lpath)
 		}
 
 		// end of walk-function
 	})
-	if err == nil {
-		os.RemoveAll(walkBase)
+	// a dry-run moves nothing, so it can't tell by the upper layer.
+	if err == nil && !m.rootMoved && exists(walkBase) {
+		rel, _ := filepath.Rel(uroot, walkBase)
+		err = m.removeFrom(m.upper, rel, walkBase)
 	}
 	return err
 }
 
+func (m *merger) record(op MergeOp) {
+	m.report = append(m.report, op)
+}
+
+// log writes the operation to the journal before it is performed.
+func (m *merger) log(rec journalRecord) error {
+	if m.journal == nil {
+		return nil
+	}
+	return m.journal.log(rec)
+}
+
+func (m *merger) lowerType(rel, lpath string) (overlayType, error) {
+	if m.dryRun && m.opened[filepath.Dir(rel)] {
+		return overlayTypeAir, nil
+	}
+	return overlayTypeByLstat(lpath)
+}
+
+func (m *merger) mkdir(rel, lpath string) error {
+	if !m.dryRun {
+		if err := m.log(journalRecord{Op: MergeMkdir, Dst: lpath}); err != nil {
+			return err
+		}
+		if err := os.Mkdir(lpath, 0755); err != nil {
+			return err
+		}
+	}
+	m.record(MergeOp{MergeMkdir, filepath.Join("/", rel), m.lower})
+	return nil
+}
+
+func (m *merger) move(action MergeAction, rel, upath, lpath string) error {
+	if !m.dryRun {
+		if err := m.log(journalRecord{Op: action, Src: upath, Dst: lpath}); err != nil {
+			return err
+		}
+		if err := os.Rename(upath, lpath); err != nil {
+			return err
+		}
+	}
+	if upath == m.root {
+		m.rootMoved = true
+	}
+	m.record(MergeOp{action, filepath.Join("/", rel), m.lower})
+	return nil
+}
+
+func (m *merger) remove(rel, lpath string) error {
+	return m.removeFrom(m.lower, rel, lpath)
+}
+
+// removeFrom moves the file to the trash, it will be removed after the
+// merge is committed.
+func (m *merger) removeFrom(layer, rel, path string) error {
+	if !m.dryRun {
+		trash := m.journal.newTrash()
+		if err := m.log(journalRecord{Op: MergeRemove, Dst: path, Trash: trash}); err != nil {
+			return err
+		}
+		if err := os.Rename(path, trash); err != nil {
+			return err
+		}
+	}
+	m.record(MergeOp{MergeRemove, filepath.Join("/", rel), layer})
+	return nil
+}
+
+func (m *merger) copyAttributes(rel, upath, lpath string) error {
+	if !m.dryRun {
+		if err := m.logAttrs(MergeCopyAttr, lpath); err != nil {
+			return err
+		}
+		if err := copyAttributes(upath, lpath); err != nil {
+			return err
+		}
+	}
+	m.record(MergeOp{MergeCopyAttr, filepath.Join("/", rel), m.lower})
+	return nil
+}
+
+func (m *merger) openDir(rel, upath, lpath string) error {
+	if m.dryRun {
+		m.opened[rel] = true
+	} else {
+		if err := m.log(journalRecord{Op: MergeOpenDir, Dst: lpath}); err != nil {
+			return err
+		}
+		if err := os.Mkdir(lpath, 0000); err != nil {
+			return err
+		}
+		if err := copyAttributes(upath, lpath); err != nil {
+			return err
+		}
+		if err := setOpaque(lpath, m.fs.overlay.UserXattr); err != nil {
+			return err
+		}
+	}
+	m.record(MergeOp{MergeOpenDir, filepath.Join("/", rel), m.lower})
+	return nil
+}
+
+func (m *merger) clearOpaque(rel, lpath string) error {
+	if !m.dryRun {
+		if err := m.logAttrs(MergeClearOpaque, lpath); err != nil {
+			return err
+		}
+		if err := clearOpaque(lpath); err != nil {
+			return err
+		}
+	}
+	m.record(MergeOp{MergeClearOpaque, filepath.Join("/", rel), m.lower})
+	return nil
+}
+
+// logAttrs writes the operation changing attributes to the journal,
+// with the original attributes to restore.
+func (m *merger) logAttrs(action MergeAction, lpath string) error {
+	attrs, err := readAttrs(lpath)
+	if err != nil {
+		return err
+	}
+	return m.log(journalRecord{Op: action, Dst: lpath, Attrs: attrs})
+}
+
 type overlayType string
 
 const (
@@ -111,32 +418,37 @@ const (
 	overlayTypeWhiteout = "x"
 	overlayTypeFile     = "f"
 	overlayTypeDir      = "d"
+	overlayTypeOpaque   = "o" // opaque directory
 )
 
+// copyAttributes copies mode, owner, timestamps and extended attributes
+// (including POSIX ACLs, capabilities and SELinux labels) of src to dst.
+// The private extended attributes of overlayfs are not copied.
 func copyAttributes(src, dst string) error {
-	args := []string{
-		"--preserve=all",
-		"--attributes-only",
-		"--no-target-directory",
-		"--recursive",
-		"--no-clobber",
-		src,
-		dst,
-	}
-	cmd := exec.Command("/bin/cp", args...)
-	a, err := cmd.CombinedOutput()
+	attrs, err := readAttrs(src)
 	if err != nil {
-		warnlog.Println("copyAttributes: FIXME:", strings.TrimSpace(string(a)))
+		return err
 	}
-	return nil
+	return attrs.apply(dst, false)
 }
 
 func createWhiteout(path string) error {
-	return syscall.Mknod(path, 0000, 0x0000)
+	return syscall.Mknod(path, syscall.S_IFCHR|0000, 0x0000)
 }
 
 func overlayTypeByLstat(path string) (overlayType, error) {
-	return overlayTypeByInfo(os.Lstat(path))
+	info, err := os.Lstat(path)
+	return overlayTypeOf(path, info, err)
+}
+
+// overlayTypeOf is overlayTypeByInfo, but it also reads the extended attributes
+// of path to recognize opaque directories.
+func overlayTypeOf(path string, info os.FileInfo, err error) (overlayType, error) {
+	tp, err := overlayTypeByInfo(info, err)
+	if tp == overlayTypeDir && isOpaque(path) {
+		return overlayTypeOpaque, nil
+	}
+	return tp, err
 }
 
 func overlayTypeByInfo(info os.FileInfo, err error) (overlayType, error) {
@@ -162,52 +474,19 @@ func isWhiteout(fi os.FileInfo) bool {
 	return fi.Sys().(*syscall.Stat_t).Rdev == 0
 }
 
-func (fs *FileSystem) nextLayerHasFile(relpath string, startindex int) (index int, hasdir bool) {
-	index = len(fs.layers)
-	hasdir = false
-	if startindex != len(fs.layers)-1 {
-		for i := startindex + 1; i <= len(fs.layers)-1; i++ {
-			iroot := filepath.Join(fs.base, fs.layers[i])
-			ipath := filepath.Join(iroot, relpath)
-			itp, _ := overlayTypeByLstat(ipath)
-			switch itp {
-			case overlayTypeFile, overlayTypeWhiteout:
-				index = i
-				return
-			case overlayTypeDir:
-				hasdir = true
-			}
-		}
-	}
-	return
-}
-
-func (fs *FileSystem) readDirInRange(relpath string, lbound, ubound int) map[string]bool {
-	filelist := make(map[string]bool)
-	for i := ubound; i >= lbound; i-- {
+// nextLayerHasDir returns whether a directory at relpath in layers under
+// startindex would appear, if the cover in layer startindex was removed.
+func (fs *FileSystem) nextLayerHasDir(relpath string, startindex int) bool {
+	for i := startindex + 1; i <= len(fs.layers)-1; i++ {
 		iroot := filepath.Join(fs.base, fs.layers[i])
 		ipath := filepath.Join(iroot, relpath)
-		iinfo, err := os.Lstat(ipath)
-		if os.IsNotExist(err) {
-			continue
-		}
-		idir, err := os.Open(ipath)
-		if err != nil {
-			continue
-		}
-		iinfos, err := idir.Readdir(0) // 0: check all sub-files
-		if err != nil {
-			continue
-		}
-		for _, iiinfo := range iinfos {
-			iitp, _ := overlayTypeByInfo(iiinfo, nil)
-			if iitp == overlayTypeWhiteout {
-				delete(filelist, iinfo.Name())
-			} else {
-				filelist[iinfo.Name()] = true
-			}
+		itp, _ := overlayTypeByLstat(ipath)
+		switch itp {
+		case overlayTypeFile, overlayTypeWhiteout:
+			return false
+		case overlayTypeDir, overlayTypeOpaque:
+			return true
 		}
-		idir.Close()
 	}
-	return filelist
+	return false
 }
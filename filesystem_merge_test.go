@@ -0,0 +1,315 @@
+package ciel
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+// testLayerFiles describes the content of a layer: a path ending with "/" is
+// a directory, "/." an opaque directory, and "!" a whiteout. Others are regular
+// files with their path as content.
+type testLayerFiles []string
+
+// newTestFileSystem creates the layers in a temporary base directory.
+// It needs root, for whiteouts and "trusted.overlay.*" extended attributes.
+func newTestFileSystem(t *testing.T, layers Layers, files map[string]testLayerFiles, userxattr bool) *FileSystem {
+	t.Helper()
+	if os.Geteuid() != 0 {
+		t.Skip("needs root")
+	}
+	base, err := ioutil.TempDir("", "ciel-test.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(base) })
+	fs, err := NewFileSystem(base, layers)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fs.SetUserXattr(userxattr)
+	if err := fs.BuildDirs(); err != nil {
+		t.Fatal(err)
+	}
+	for name, paths := range files {
+		root := fs.Layer(name)
+		for _, p := range paths {
+			if err := createTestFile(root, p, userxattr); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	return fs
+}
+
+func createTestFile(root, p string, userxattr bool) error {
+	switch {
+	case filepath.Base(p) == ".":
+		dir := filepath.Join(root, filepath.Dir(p))
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return err
+		}
+		return setOpaque(dir, userxattr)
+	case p[len(p)-1] == '/':
+		return os.MkdirAll(filepath.Join(root, p), 0755)
+	case p[len(p)-1] == '!':
+		path := filepath.Join(root, p[:len(p)-1])
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			return err
+		}
+		return createWhiteout(path)
+	}
+	path := filepath.Join(root, p)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, []byte(p), 0644)
+}
+
+// mergedPaths lists the paths of a merged view, see viewSignature().
+func mergedPaths(t *testing.T, sigs map[string]string) []string {
+	t.Helper()
+	paths := make([]string, 0, len(sigs))
+	for p := range sigs {
+		paths = append(paths, p)
+	}
+	sort.Strings(paths)
+	return paths
+}
+
+func TestMergeFileOpaque(t *testing.T) {
+	layers := Layers{"99-top", "60-upper", "30-lower", "00-bottom"}
+	tests := []struct {
+		name      string
+		files     map[string]testLayerFiles
+		userxattr bool
+		upper     string
+		lower     string
+		// the merged view after merging, from "upper" down.
+		want []string
+		// directories which must be opaque in the lower layer, and not.
+		opaque, notOpaque []string
+	}{
+		{
+			name: "opaque upper over lower dir",
+			files: map[string]testLayerFiles{
+				"upper":  {"etc/.", "etc/new"},
+				"lower":  {"etc/old"},
+				"bottom": {"etc/older", "etc/sub/deep"},
+			},
+			upper: "upper", lower: "lower",
+			want:   []string{"etc", "etc/new"},
+			opaque: []string{"etc"},
+		},
+		{
+			name: "opaque upper merged into the bottom",
+			files: map[string]testLayerFiles{
+				"lower":  {"etc/.", "etc/new"},
+				"bottom": {"etc/old"},
+			},
+			upper: "lower", lower: "bottom",
+			want:      []string{"etc", "etc/new"},
+			notOpaque: []string{"etc"},
+		},
+		{
+			name: "dir over lower whiteout with dir further down",
+			files: map[string]testLayerFiles{
+				"upper":  {"etc/new"},
+				"lower":  {"etc!"},
+				"bottom": {"etc/old"},
+			},
+			upper: "upper", lower: "lower",
+			want:   []string{"etc", "etc/new"},
+			opaque: []string{"etc"},
+		},
+		{
+			name: "dir over lower whiteout with dir further down, userxattr",
+			files: map[string]testLayerFiles{
+				"upper":  {"etc/new"},
+				"lower":  {"etc!"},
+				"bottom": {"etc/old"},
+			},
+			userxattr: true,
+			upper:     "upper", lower: "lower",
+			want:   []string{"etc", "etc/new"},
+			opaque: []string{"etc"},
+		},
+		{
+			name: "dir over lower whiteout with nothing below",
+			files: map[string]testLayerFiles{
+				"upper": {"etc/new"},
+				"lower": {"etc!"},
+			},
+			upper: "upper", lower: "lower",
+			want:      []string{"etc", "etc/new"},
+			notOpaque: []string{"etc"},
+		},
+		{
+			name: "file deleted then recreated",
+			files: map[string]testLayerFiles{
+				"upper":  {"f"},
+				"lower":  {"f!"},
+				"bottom": {"f"},
+			},
+			upper: "upper", lower: "lower",
+			want: []string{"f"},
+		},
+		{
+			name: "dir deleted then recreated as a file",
+			files: map[string]testLayerFiles{
+				"upper":  {"etc"},
+				"lower":  {"etc!"},
+				"bottom": {"etc/old"},
+			},
+			upper: "upper", lower: "lower",
+			want: []string{"etc"},
+		},
+		{
+			name: "whiteout over lower file",
+			files: map[string]testLayerFiles{
+				"upper":  {"f!"},
+				"lower":  {"f"},
+				"bottom": {"f"},
+			},
+			upper: "upper", lower: "lower",
+			want: []string{},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fs := newTestFileSystem(t, layers, tt.files, tt.userxattr)
+			uindex := fs.layers.Index(tt.upper)
+			before, err := fs.viewSignature(uindex)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := fs.MergeFile("/", tt.upper, tt.lower, true); err != nil {
+				t.Fatal("MergeFile:", err)
+			}
+			after, err := fs.viewSignature(uindex)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(before, after) {
+				t.Errorf("merged view changed:\nbefore %v\nafter  %v", before, after)
+			}
+			if got := mergedPaths(t, after); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("merged view = %v, want %v", got, tt.want)
+			}
+			if got := mergedPaths(t, mustViewSignature(t, fs, fs.layers.Index(tt.lower))); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("merged view from the lower layer = %v, want %v", got, tt.want)
+			}
+			for _, dir := range tt.opaque {
+				path := filepath.Join(fs.Layer(tt.lower), dir)
+				if !isOpaque(path) {
+					t.Errorf("%s is not opaque", path)
+				}
+				// only the attribute of the mode in use is set.
+				other := overlayXattrPrefix + "opaque"
+				if !tt.userxattr {
+					other = overlayUserXattrPrefix + "opaque"
+				}
+				if _, err := lgetxattr(path, other); err == nil {
+					t.Errorf("%s has %s", path, other)
+				}
+			}
+			for _, dir := range tt.notOpaque {
+				if path := filepath.Join(fs.Layer(tt.lower), dir); isOpaque(path) {
+					t.Errorf("%s is opaque", path)
+				}
+			}
+		})
+	}
+}
+
+func mustViewSignature(t *testing.T, fs *FileSystem, lbound int) map[string]string {
+	t.Helper()
+	sigs, err := fs.viewSignature(lbound)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return sigs
+}
+
+func TestPlanMergeFile(t *testing.T) {
+	layers := Layers{"99-top", "60-upper", "30-lower", "00-bottom"}
+	tests := []struct {
+		name        string
+		files       map[string]testLayerFiles
+		path        string
+		excludeSelf bool
+	}{
+		{"new dir", map[string]testLayerFiles{"upper": {"newdir/f"}}, "/newdir", false},
+		{"new file", map[string]testLayerFiles{"upper": {"f"}}, "/f", false},
+		{"existing dir", map[string]testLayerFiles{"upper": {"etc/new"}, "lower": {"etc/old"}}, "/etc", false},
+		{"existing dir, exclude self", map[string]testLayerFiles{"upper": {"etc/new"}, "lower": {"etc/old"}}, "/etc", true},
+		{"opaque dir", map[string]testLayerFiles{"upper": {"etc/.", "etc/new"}, "lower": {"etc/old"}}, "/etc", false},
+		{"whiteout", map[string]testLayerFiles{"upper": {"f!"}, "lower": {"f"}, "bottom": {"f"}}, "/f", false},
+		{"dir over whiteout", map[string]testLayerFiles{"upper": {"etc/new"}, "lower": {"etc!"}, "bottom": {"etc/old"}}, "/etc", false},
+		{"root", map[string]testLayerFiles{"upper": {"a/b", "c!", "d/."}, "lower": {"a/", "c", "d/e"}}, "/", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fs := newTestFileSystem(t, layers, tt.files, false)
+			plan, err := fs.PlanMergeFile(tt.path, "upper", "lower", tt.excludeSelf)
+			if err != nil {
+				t.Fatal("PlanMergeFile:", err)
+			}
+			report, err := fs.MergeFileReport(tt.path, "upper", "lower", tt.excludeSelf)
+			if err != nil {
+				t.Fatal("MergeFileReport:", err)
+			}
+			if !reflect.DeepEqual(plan, report) {
+				t.Errorf("plan %v, report %v", plan, report)
+			}
+		})
+	}
+}
+
+func TestNotSelfContained(t *testing.T) {
+	for _, name := range []string{"metacopy", "redirect"} {
+		t.Run(name, func(t *testing.T) {
+			fs := newTestFileSystem(t, Layers{"99-top", "60-upper", "30-lower"}, map[string]testLayerFiles{
+				"top":   {"etc/f"},
+				"upper": {"etc/f"},
+				"lower": {"etc/"},
+			}, false)
+			for _, layer := range []string{"top", "upper"} {
+				if err := lsetxattr(filepath.Join(fs.Layer(layer), "etc/f"), overlayXattrPrefix+name, []byte{}, 0); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if _, err := fs.PlanMergeFile("/etc", "upper", "lower", false); err != ErrNotSelfContained {
+				t.Errorf("PlanMergeFile: %v, want %v", err, ErrNotSelfContained)
+			}
+			if err := fs.MergeFile("/etc", "upper", "lower", false); err != ErrNotSelfContained {
+				t.Errorf("MergeFile: %v, want %v", err, ErrNotSelfContained)
+			}
+			if !exists(filepath.Join(fs.Layer("upper"), "etc/f")) {
+				t.Error("MergeFile moved the file")
+			}
+			if err := fs.Commit("committed"); err != ErrNotSelfContained {
+				t.Errorf("Commit: %v, want %v", err, ErrNotSelfContained)
+			}
+			if err := fs.ExportLayer("upper", ioutil.Discard, FormatTar); err != ErrNotSelfContained {
+				t.Errorf("ExportLayer: %v, want %v", err, ErrNotSelfContained)
+			}
+			for _, format := range []ArchiveFormat{FormatTar, FormatSquashfs} {
+				if err := fs.ExportRootfs(ioutil.Discard, format); err != ErrNotSelfContained {
+					t.Errorf("ExportRootfs(%v): %v, want %v", format, err, ErrNotSelfContained)
+				}
+			}
+			// a disabled layer is not exported.
+			if err := lremovexattr(filepath.Join(fs.Layer("top"), "etc/f"), overlayXattrPrefix+name); err != nil {
+				t.Fatal(err)
+			}
+			fs.DisableLayer("upper")
+			if err := fs.ExportRootfs(ioutil.Discard, FormatTar); err != nil {
+				t.Errorf("ExportRootfs with the layers disabled: %v", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,192 @@
+package ciel
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// LayerMetaDir is the directory in the base directory keeping the metadata
+// of layers, one "<name>.json" file per layer. Metadata follows the name of
+// the layer, so renumbering layers doesn't affect it.
+const LayerMetaDir = ".layers"
+
+// LayerMeta is the metadata of a layer.
+type LayerMeta struct {
+	Name        string    `json:"name"`
+	Created     time.Time `json:"created"`
+	Modified    time.Time `json:"modified"`
+	Description string    `json:"description,omitempty"`
+	Parent      string    `json:"parent,omitempty"`  // the layer below it, when it was created
+	Digest      string    `json:"digest,omitempty"`  // see FileSystem.Digest()
+	Size        int64     `json:"size"`              // total size of files in bytes
+	Command     string    `json:"command,omitempty"` // the command or operation creating it
+	Shift       uint32    `json:"shift,omitempty"`   // see FileSystem.OwnershipShift()
+}
+
+// LayerInfo describes a layer of the file system, see ListLayers().
+type LayerInfo struct {
+	Name    string    `json:"name"`
+	Dir     string    `json:"dir"` // full name of the directory, eg. "50-custom"
+	Enabled bool      `json:"enabled"`
+	Meta    LayerMeta `json:"meta"`
+}
+
+// String formats the layer info like "50-custom  1024  2017-01-01T00:00:00Z  description".
+func (li LayerInfo) String() string {
+	s := fmt.Sprintf("%s  %d  %s", li.Dir, li.Meta.Size, li.Meta.Created.Format(time.RFC3339))
+	if !li.Enabled {
+		s += "  (disabled)"
+	}
+	if li.Meta.Description != "" {
+		s += "  " + li.Meta.Description
+	}
+	return s
+}
+
+// ListLayers returns the layers with their metadata, from top to bottom.
+func (fs *FileSystem) ListLayers() ([]LayerInfo, error) {
+	fs.lock.RLock()
+	defer fs.lock.RUnlock()
+	infos := make([]LayerInfo, len(fs.layers))
+	for i, fullname := range fs.layers {
+		meta, err := fs.LayerMeta(layerName(fullname))
+		if err != nil {
+			return nil, err
+		}
+		infos[i] = LayerInfo{
+			Name:    layerName(fullname),
+			Dir:     fullname,
+			Enabled: i == 0 || fs.layersMask[i],
+			Meta:    meta,
+		}
+	}
+	return infos, nil
+}
+
+// LayerMeta reads the metadata of a layer. If the layer has no metadata,
+// an empty one with only the name is returned.
+func (fs *FileSystem) LayerMeta(name string) (LayerMeta, error) {
+	meta := LayerMeta{Name: name}
+	b, err := ioutil.ReadFile(fs.layerMetaPath(name))
+	if os.IsNotExist(err) {
+		return meta, nil
+	} else if err != nil {
+		return meta, err
+	}
+	err = json.Unmarshal(b, &meta)
+	return meta, err
+}
+
+// SetLayerMeta writes the metadata of the layer meta.Name.
+func (fs *FileSystem) SetLayerMeta(meta LayerMeta) error {
+	if fs.layers.find(meta.Name) == -1 {
+		return fmt.Errorf("no such layer: %q", meta.Name)
+	}
+	return fs.writeLayerMeta(meta)
+}
+
+func (fs *FileSystem) writeLayerMeta(meta LayerMeta) error {
+	b, err := json.MarshalIndent(meta, "", "  ")
+	if err != nil {
+		return err
+	}
+	path := fs.layerMetaPath(meta.Name)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	// write to a temporary file, and replace the old one atomically.
+	if err := ioutil.WriteFile(path+".tmp", append(b, '\n'), 0644); err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+func (fs *FileSystem) layerMetaPath(name string) string {
+	return filepath.Join(fs.base, LayerMetaDir, name+".json")
+}
+
+// createLayerMeta writes the metadata of a new layer at index.
+func (fs *FileSystem) createLayerMeta(index int, command, description string) {
+	now := time.Now().UTC()
+	meta := LayerMeta{
+		Name:        layerName(fs.layers[index]),
+		Created:     now,
+		Modified:    now,
+		Description: description,
+		Command:     command,
+	}
+	if index+1 < len(fs.layers) {
+		meta.Parent = layerName(fs.layers[index+1])
+	}
+	fs.updateLayerMeta(meta, true)
+}
+
+// touchLayerMeta updates the metadata of a changed layer.
+func (fs *FileSystem) touchLayerMeta(name string) {
+	meta, err := fs.LayerMeta(name)
+	if err != nil {
+		warnlog.Println("touchLayerMeta:", err)
+		return
+	}
+	now := time.Now().UTC()
+	if meta.Created.IsZero() {
+		meta.Created = now
+	}
+	meta.Modified = now
+	fs.updateLayerMeta(meta, fs.hasManifest(name))
+}
+
+// updateLayerMeta recomputes the size and writes the metadata. If seal is
+// true, the manifest and the digest are recomputed too.
+// Failures are only logged, since the layer itself has been changed.
+func (fs *FileSystem) updateLayerMeta(meta LayerMeta, seal bool) {
+	meta.Digest = ""
+	if seal {
+		m, err := fs.computeManifest(meta.Name)
+		if err == nil {
+			err = fs.writeManifest(meta.Name, m)
+		}
+		if err != nil {
+			warnlog.Println("updateLayerMeta:", err)
+		} else {
+			meta.Digest = m.digest()
+		}
+	}
+	size, err := layerSize(filepath.Join(fs.base, fs.layers.Path(meta.Name)))
+	if err != nil {
+		warnlog.Println("updateLayerMeta:", err)
+	}
+	meta.Size = size
+	if err := fs.writeLayerMeta(meta); err != nil {
+		warnlog.Println("updateLayerMeta:", err)
+	}
+}
+
+// removeLayerMeta removes the metadata and the manifest of a removed layer.
+func (fs *FileSystem) removeLayerMeta(name string) {
+	for _, path := range []string{fs.layerMetaPath(name), fs.manifestPath(name)} {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			warnlog.Println("removeLayerMeta:", err)
+		}
+	}
+}
+
+func layerSize(dir string) (int64, error) {
+	var size int64
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if os.IsNotExist(err) && path == dir {
+			return filepath.SkipDir
+		} else if err != nil {
+			return err
+		}
+		if info.Mode().IsRegular() {
+			size += info.Size()
+		}
+		return nil
+	})
+	return size, err
+}
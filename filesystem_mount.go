@@ -2,9 +2,11 @@ package ciel
 
 import (
 	"encoding/base64"
+	"fmt"
 	"math/rand"
 	"os"
 	"path/filepath"
+	"runtime"
 	"strings"
 	"syscall"
 )
@@ -64,6 +66,7 @@ func (fs *FileSystem) Mount() error {
 }
 
 // MountReadOnly mounts the file system to a temporary directory, read-only.
+// It fails with ErrMountedReadWrite if the file system is mounted read-write.
 func (fs *FileSystem) MountReadOnly() error {
 	return fs.mount(false)
 }
@@ -72,14 +75,31 @@ func (fs *FileSystem) mount(rw bool) error {
 	fs.lock.Lock()
 	defer fs.lock.Unlock()
 	if fs.mounted {
+		if !rw && !fs.readOnly {
+			return ErrMountedReadWrite
+		}
 		return nil
 	}
+	if fs.scratch != "" {
+		// Unmount() failed to persist the changes in the scratch directory.
+		return ErrNotPersisted
+	}
+	if rw && fs.tmpfsUpper && fs.rootless {
+		// tmpfs can't be mounted outside of the namespace without root.
+		errlog.Println("mount: SetTmpfsUpper() =>", ErrRootless)
+		return ErrRootless
+	}
 
 	if err := fs.BuildDirs(); err != nil {
 		return err
 	}
 
+	scratch := rw && (fs.ephemeral || fs.tmpfsUpper)
 	lowersToMount := []string{}
+	if scratch {
+		// the top layer is a lower layer, below the scratch upper.
+		lowersToMount = append(lowersToMount, fs.TopLayer())
+	}
 	for i := range fs.layers {
 		if i != 0 && fs.layersMask[i] {
 			dirname := filepath.Join(fs.base, fs.layers[i])
@@ -87,32 +107,137 @@ func (fs *FileSystem) mount(rw bool) error {
 		}
 	}
 
-	fs.target = "/tmp/ciel." + randomFilename()
-	os.Mkdir(fs.TargetDir(), 0755)
-	os.Mkdir(fs.TopLayerWorkDir(), 0755)
-	reterr := fsMount(fs.TargetDir(), rw, fs.TopLayer(), fs.TopLayerWorkDir(), lowersToMount)
+	upperdir, workdir := fs.TopLayer(), fs.TopLayerWorkDir()
+	if scratch {
+		if err := fs.mountScratch(); err != nil {
+			return err
+		}
+		upperdir, workdir = fs.scratchUpper(), filepath.Join(fs.scratch, "work")
+	} else {
+		if fs.overlay.Volatile {
+			// a volatile mount leaves a mark in the work directory,
+			// which fails the next mount after a crash.
+			os.RemoveAll(workdir)
+		}
+		os.Mkdir(workdir, 0755)
+	}
+
+	target := "/tmp/ciel." + randomFilename()
+	os.Mkdir(target, 0755)
+	var reterr error
+	if fs.rootless {
+		fs.target, reterr = fs.mountRootless(target, rw, upperdir, workdir, lowersToMount)
+	} else {
+		fs.target = target
+		reterr = fsMount(target, rw, upperdir, workdir, lowersToMount, fs.overlay)
+	}
 	if reterr == nil {
-		fs.mounted = true
+		fs.mounted, fs.readOnly = true, !rw
+	} else {
+		os.Remove(target)
+		fs.unmountScratch()
 	}
 	return reterr
 }
 
+// mountScratch creates the scratch directory of an ephemeral or tmpfs-backed
+// mount in the base directory. An ephemeral mount falls back to the disk
+// if tmpfs can't be mounted, and it's always on the disk in the rootless mode.
+func (fs *FileSystem) mountScratch() error {
+	fs.scratch = filepath.Join(fs.base, ".ephemeral."+randomFilename())
+	if err := os.Mkdir(fs.scratch, 0700); err != nil {
+		fs.scratch = ""
+		return err
+	}
+	option := "mode=0700"
+	if fs.tmpfsUpper && fs.tmpfsSize != "" {
+		option += ",size=" + fs.tmpfsSize
+	}
+	var err error
+	if fs.rootless {
+		err = ErrRootless
+	} else {
+		err = syscall.Mount("tmpfs", fs.scratch, "tmpfs", 0, option)
+		dbglog.Println("mountScratch: syscall.Mount() =>", err)
+	}
+	if err != nil {
+		if fs.tmpfsUpper {
+			errlog.Println("mountScratch: syscall.Mount() =>", err)
+			fs.unmountScratch()
+			return err
+		}
+		warnlog.Println("mountScratch: no tmpfs, using the disk:", err)
+	}
+	fs.scratchTmpfs = err == nil
+	for _, dir := range []string{"upper", "work"} {
+		if err := os.Mkdir(filepath.Join(fs.scratch, dir), 0755); err != nil {
+			fs.unmountScratch()
+			return err
+		}
+	}
+	return nil
+}
+
+func (fs *FileSystem) scratchUpper() string {
+	return filepath.Join(fs.scratch, "upper")
+}
+
+// unmountScratch removes the scratch directory of an ephemeral mount.
+func (fs *FileSystem) unmountScratch() error {
+	if fs.scratch == "" {
+		return nil
+	}
+	if fs.scratchTmpfs {
+		if err := syscall.Unmount(fs.scratch, 0); err != nil {
+			return err
+		}
+		fs.scratchTmpfs = false
+	}
+	removeWorkDir(filepath.Join(fs.scratch, "work"))
+	if err := os.RemoveAll(fs.scratch); err != nil {
+		return err
+	}
+	fs.scratch = ""
+	return nil
+}
+
 // Unmount the file system, and cleans the temporary directories.
+// If it failed to persist the changes, see SetPersistOnUnmount(), calling it
+// again retries.
 func (fs *FileSystem) Unmount() error {
 	fs.lock.Lock()
 	defer fs.lock.Unlock()
-	if !fs.mounted {
+	if !fs.mounted && fs.scratch == "" {
 		return nil
 	}
 
-	if err := fsUnmount(fs.TargetDir()); err != nil {
-		return err
-	}
-	defer func() {
+	var err1 error
+	if fs.mounted {
+		if fs.rootlessNS != nil {
+			err1 = fs.unmountRootless()
+		} else {
+			if err := fsUnmount(fs.TargetDir()); err != nil {
+				return err
+			}
+			err1 = os.Remove(fs.TargetDir())
+		}
 		fs.mounted = false
-	}()
-	err1 := os.Remove(fs.TargetDir())
-	err2 := os.RemoveAll(fs.TopLayerWorkDir())
+	}
+	fs.removeStaleTops()
+	var err2 error
+	if fs.scratch != "" && fs.persistOnUnmount && fs.tmpfsUpper && !fs.ephemeral {
+		if err := fs.persistUpper(); err != nil {
+			// keep the changes and the scratch directory for a retry.
+			errlog.Println("Unmount: the changes are kept in", fs.scratch)
+			return err
+		}
+		fs.removeStaleTops()
+	}
+	if fs.scratch != "" {
+		err2 = fs.unmountScratch()
+	} else {
+		err2 = removeWorkDir(fs.TopLayerWorkDir())
+	}
 	if err2 != nil {
 		return err2
 	}
@@ -131,20 +256,98 @@ func randomFilename() string {
 	return base64.RawURLEncoding.EncodeToString(rd)
 }
 
-func fsMount(path string, rw bool, upperdir string, workdir string, lowerdirs []string) error {
-	var option string
-	if rw {
-		option = "lowerdir=" + strings.Join(lowerdirs, ":") + ",upperdir=" + upperdir + ",workdir=" + workdir
-	} else {
-		option = "lowerdir=" + strings.Join(append(lowerdirs, upperdir), ":")
+func fsMount(path string, rw bool, upperdir string, workdir string, lowerdirs []string, overlay OverlayOptions) error {
+	if !rw {
+		// the top layer is the highest lower layer.
+		lowerdirs = append([]string{upperdir}, lowerdirs...)
+		upperdir, workdir = "", ""
 	}
+	opts := overlay.mountOptions(rw)
+	option := overlayMountData(upperdir, workdir, lowerdirs, opts)
 	infolog.Println("mount", path)
+	if len(option) <= mountDataLimit() {
+		return mountOverlay(path, option)
+	}
+
+	// long layer stacks don't fit in a page, which is the limit of mount(2).
+	warnlog.Printf("fsMount: the mount options are %d bytes, over the limit of %d bytes\n", len(option), mountDataLimit())
+	err := fsMountNewAPI(path, upperdir, workdir, lowerdirs, opts)
+	if err == nil {
+		return nil
+	}
+	dbglog.Println("fsMount: fsMountNewAPI() =>", err)
+	return fsMountRelative(path, upperdir, workdir, lowerdirs, opts)
+}
+
+// fsMountRelative mounts with the paths relative to the directory of the
+// bottom layer, to shorten the mount options. The working directory is
+// changed in a thread which does not share it with others.
+func fsMountRelative(path string, upperdir string, workdir string, lowerdirs []string, opts []string) error {
+	dir := filepath.Dir(lowerdirs[len(lowerdirs)-1])
+	rel := func(p string) string {
+		if p == "" {
+			return ""
+		}
+		r, err := filepath.Rel(dir, p)
+		if err != nil {
+			return p
+		}
+		return r
+	}
+	relLowerdirs := make([]string, len(lowerdirs))
+	for i, lowerdir := range lowerdirs {
+		relLowerdirs[i] = rel(lowerdir)
+	}
+	option := overlayMountData(rel(upperdir), rel(workdir), relLowerdirs, opts)
+	if len(option) > mountDataLimit() {
+		err := fmt.Errorf("too many layers to mount: the mount options are %d bytes with relative paths, over the limit of %d bytes, and the new mount API with \"lowerdir+\" (Linux 6.8) is not available",
+			len(option), mountDataLimit())
+		errlog.Println("fsMount:", err)
+		return err
+	}
+
+	ch := make(chan error)
+	go func() {
+		// the thread is not unlocked, so it exits with the goroutine.
+		runtime.LockOSThread()
+		if err := syscall.Unshare(syscall.CLONE_FS); err != nil {
+			ch <- os.NewSyscallError("unshare", err)
+			return
+		}
+		if err := syscall.Chdir(dir); err != nil {
+			ch <- err
+			return
+		}
+		ch <- mountOverlay(path, option)
+	}()
+	return <-ch
+}
+
+func mountOverlay(path, option string) error {
 	dbglog.Println("fsMount: syscall.Mount() <=", path, option)
 	err := syscall.Mount("overlay", path, "overlay", 0, option)
 	dbglog.Println("fsMount: syscall.Mount() =>", err)
 	return err
 }
 
+// overlayMountData joins the options of overlayfs for mount(2).
+func overlayMountData(upperdir string, workdir string, lowerdirs []string, opts []string) string {
+	option := "lowerdir=" + strings.Join(lowerdirs, ":")
+	if upperdir != "" {
+		option += ",upperdir=" + upperdir + ",workdir=" + workdir
+	}
+	for _, opt := range opts {
+		option += "," + opt
+	}
+	return option
+}
+
+// mountDataLimit is the maximum length of the options of mount(2),
+// without the terminating null byte.
+func mountDataLimit() int {
+	return os.Getpagesize() - 1
+}
+
 func fsUnmount(path string) error {
 	infolog.Println("umount", path)
 	dbglog.Println("fsUnmount: syscall.Unmount() <=", path)
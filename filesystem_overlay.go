@@ -0,0 +1,217 @@
+package ciel
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// ErrOverlayUnsupported is returned by SetOverlayOptions() when the kernel
+// does not support a requested option of overlayfs.
+var ErrOverlayUnsupported = errors.New("unsupported by the overlayfs of the kernel")
+
+// ErrNotSelfContained is returned when a layer has files written by overlayfs
+// with metacopy or redirect_dir, which refer to the layers below it, so they
+// can't be merged, committed, exported or persisted.
+var ErrNotSelfContained = errors.New("the layer has metacopy or redirect entries of overlayfs")
+
+// OverlayParametersDir is where the kernel shows the parameters of the
+// overlay module, one file per feature.
+const OverlayParametersDir = "/sys/module/overlay/parameters"
+
+// OverlayOptions are the mount options of overlayfs. An empty string keeps
+// the default of the kernel. See Documentation/filesystems/overlayfs.rst
+// of Linux for details.
+type OverlayOptions struct {
+	Index string `json:"index,omitempty"` // "on" or "off"
+	Xino  string `json:"xino,omitempty"`  // "on", "off" or "auto"
+
+	// Metacopy "on" copies up only the metadata of files on chown() or
+	// chmod(), and RedirectDir "on" renames directories without copying
+	// them. The top layer is not self-contained with either of them, so
+	// MergeFile(), Commit(), ExportLayer() and PersistUpper() refuse it
+	// with ErrNotSelfContained.
+	Metacopy    string `json:"metacopy,omitempty"`     // "on" or "off"
+	RedirectDir string `json:"redirect_dir,omitempty"` // "on", "follow", "nofollow" or "off"
+
+	// UserXattr makes overlayfs use "user.overlay.*" instead of
+	// "trusted.overlay.*" extended attributes, in MergeFile() too.
+	UserXattr bool `json:"userxattr,omitempty"`
+
+	// Volatile skips syncing the upper directory to the disk. If the system
+	// crashes while it's mounted, the changes may be partially lost.
+	Volatile bool `json:"volatile,omitempty"`
+}
+
+// overlayFeature describes when an option was added to overlayfs, and the
+// module parameter showing it, if any.
+type overlayFeature struct {
+	name      string
+	values    []string
+	param     string
+	sinceMaj  int
+	sinceMin  int
+	requested func(o OverlayOptions) bool
+}
+
+var overlayFeatures = []overlayFeature{
+	{"index", []string{"on", "off"}, "index", 4, 13,
+		func(o OverlayOptions) bool { return o.Index != "" }},
+	{"xino", []string{"on", "off", "auto"}, "xino_auto", 4, 17,
+		func(o OverlayOptions) bool { return o.Xino != "" }},
+	{"metacopy", []string{"on", "off"}, "metacopy", 4, 19,
+		func(o OverlayOptions) bool { return o.Metacopy != "" }},
+	{"redirect_dir", []string{"on", "follow", "nofollow", "off"}, "redirect_dir", 4, 10,
+		func(o OverlayOptions) bool { return o.RedirectDir != "" }},
+	{"userxattr", nil, "", 5, 11,
+		func(o OverlayOptions) bool { return o.UserXattr }},
+	{"volatile", nil, "", 5, 10,
+		func(o OverlayOptions) bool { return o.Volatile }},
+}
+
+// OverlayOptions returns the mount options of overlayfs.
+func (fs *FileSystem) OverlayOptions() OverlayOptions {
+	return fs.overlay
+}
+
+// SetOverlayOptions sets the mount options of overlayfs, after checking that
+// they are valid and supported by the kernel. It will go into effect at the
+// next mount.
+func (fs *FileSystem) SetOverlayOptions(o OverlayOptions) error {
+	if err := o.check(); err != nil {
+		errlog.Println("SetOverlayOptions:", err)
+		return err
+	}
+	fs.overlay = o
+	return nil
+}
+
+func (o OverlayOptions) check() error {
+	values := map[string]string{
+		"index":        o.Index,
+		"xino":         o.Xino,
+		"metacopy":     o.Metacopy,
+		"redirect_dir": o.RedirectDir,
+	}
+	for _, f := range overlayFeatures {
+		if !f.requested(o) {
+			continue
+		}
+		if f.values != nil && !isOneOf(values[f.name], f.values) {
+			return fmt.Errorf("invalid overlayfs option: %s=%s", f.name, values[f.name])
+		}
+		if !f.supported() {
+			return fmt.Errorf("%s: %v", f.name, ErrOverlayUnsupported)
+		}
+	}
+	// the kernel refuses them, see ovl_parse_param() of Linux.
+	if o.UserXattr && (o.Metacopy == "on" || o.RedirectDir == "on" || o.RedirectDir == "follow") {
+		return errors.New("overlayfs option userxattr conflicts with metacopy and redirect_dir")
+	}
+	if o.Metacopy == "on" && (o.RedirectDir == "off" || o.RedirectDir == "nofollow") {
+		return errors.New("overlayfs option metacopy=on needs redirect_dir")
+	}
+	return nil
+}
+
+// supported returns whether the kernel supports the feature, by the module
+// parameter, or the version of the kernel if the module is not loaded.
+func (f overlayFeature) supported() bool {
+	if f.param != "" && exists(OverlayParametersDir) {
+		return exists(OverlayParametersDir + "/" + f.param)
+	}
+	major, minor, err := kernelVersion()
+	if err != nil {
+		warnlog.Println("overlayFeature:", err)
+		return true
+	}
+	return major > f.sinceMaj || major == f.sinceMaj && minor >= f.sinceMin
+}
+
+// mountOptions returns the options for a mount, without the directories.
+func (o OverlayOptions) mountOptions(rw bool) []string {
+	var opts []string
+	for _, kv := range [][2]string{
+		{"index", o.Index},
+		{"xino", o.Xino},
+		{"metacopy", o.Metacopy},
+		{"redirect_dir", o.RedirectDir},
+	} {
+		if kv[1] != "" {
+			opts = append(opts, kv[0]+"="+kv[1])
+		}
+	}
+	if o.UserXattr {
+		opts = append(opts, "userxattr")
+	}
+	if o.Volatile && rw {
+		opts = append(opts, "volatile")
+	}
+	return opts
+}
+
+// kernelVersion returns the version of the running kernel, eg. 5, 10.
+func kernelVersion() (major, minor int, err error) {
+	var uts syscall.Utsname
+	if err := syscall.Uname(&uts); err != nil {
+		return 0, 0, os.NewSyscallError("uname", err)
+	}
+	var release []byte
+	for _, c := range uts.Release {
+		if c == 0 {
+			break
+		}
+		release = append(release, byte(c))
+	}
+	fields := strings.SplitN(string(release), ".", 3)
+	if len(fields) < 2 {
+		return 0, 0, fmt.Errorf("unknown kernel release: %q", release)
+	}
+	// the minor version may have a suffix, eg. "5.10-rc1".
+	if i := strings.IndexFunc(fields[1], func(r rune) bool { return r < '0' || r > '9' }); i != -1 {
+		fields[1] = fields[1][:i]
+	}
+	major, err1 := strconv.Atoi(fields[0])
+	minor, err2 := strconv.Atoi(fields[1])
+	if err1 != nil || err2 != nil {
+		return 0, 0, fmt.Errorf("unknown kernel release: %q", release)
+	}
+	return major, minor, nil
+}
+
+func isOneOf(s string, values []string) bool {
+	for _, v := range values {
+		if s == v {
+			return true
+		}
+	}
+	return false
+}
+
+// checkSelfContained returns ErrNotSelfContained if any file in the tree at
+// root carries the "metacopy" or "redirect" extended attribute of overlayfs.
+func checkSelfContained(root string) error {
+	err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if os.IsNotExist(err) && path == root {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		names, err := llistxattr(path)
+		if err != nil {
+			return err
+		}
+		for _, name := range names {
+			if isOverlayXattr(name) && (strings.HasSuffix(name, ".metacopy") || strings.HasSuffix(name, ".redirect")) {
+				errlog.Printf("%s: %s\n", path, name)
+				return ErrNotSelfContained
+			}
+		}
+		return nil
+	})
+	return err
+}
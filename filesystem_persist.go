@@ -0,0 +1,246 @@
+package ciel
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+// ErrNoTmpfsUpper is returned by PersistUpper() when the file system is not
+// mounted with a tmpfs-backed upper directory.
+var ErrNoTmpfsUpper = errors.New("the file system is not mounted with a tmpfs upper directory")
+
+// ErrNotPersisted is returned by Mount() when Unmount() failed to persist the
+// changes of the last mount, see SetPersistOnUnmount().
+var ErrNotPersisted = errors.New("the changes of the last mount are not persisted")
+
+// PersistUpper saves the changes in the tmpfs-backed upper directory into
+// the top layer, while the file system is mounted, see SetTmpfsUpper().
+// Later changes are saved by calling it again.
+//
+// The top layer is replaced by an updated copy, and the mount keeps the old
+// one as its lower layer until it's unmounted. The upper directory is copied
+// while it's being written to, so stop everything writing to the file system
+// first, or use SetPersistOnUnmount(), which saves the changes safely after
+// unmounting.
+func (fs *FileSystem) PersistUpper() error {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+	if !fs.mounted || fs.scratch == "" || !fs.tmpfsUpper || fs.ephemeral {
+		return ErrNoTmpfsUpper
+	}
+	return fs.persistUpper()
+}
+
+// SetPersistOnUnmount makes Unmount() save the changes in the tmpfs-backed
+// upper directory into the top layer, after unmounting overlayfs, see
+// SetTmpfsUpper(). The top layer is replaced when all the changes are saved.
+// If it fails, the changes are kept in the scratch directory in the base
+// directory, and Unmount() returns the error: call it again to retry, or
+// disable persisting first to discard them. The file system can't be mounted
+// until then. It will go into effect at the next unmount.
+func (fs *FileSystem) SetPersistOnUnmount(enable bool) {
+	fs.persistOnUnmount = enable
+}
+
+// PersistStagingName is the directory in the base directory where the top
+// layer is prepared by persisting, before it's swapped in.
+const PersistStagingName = ".persist"
+
+// persistUpper persists the upper into a copy of the top layer, and swaps it
+// in, so the top layer is never left half-updated. The copy links the files
+// of the top layer, which the persister replaces instead of writing to.
+//
+// The replaced top layer may still be a lower layer of the mount, it's
+// removed by removeStaleTops() after unmounting.
+func (fs *FileSystem) persistUpper() error {
+	if err := checkSelfContained(fs.scratchUpper()); err != nil {
+		return err
+	}
+	infolog.Println("persist upper ->", fs.layers[0])
+	staging := filepath.Join(fs.base, PersistStagingName)
+	if err := os.RemoveAll(staging); err != nil {
+		return err
+	}
+	p := &persister{
+		upper:     fs.scratchUpper(),
+		lower:     staging,
+		userxattr: fs.overlay.UserXattr,
+		links:     make(map[uint64]string),
+	}
+	err := linkTree(fs.TopLayer(), staging)
+	if err == nil {
+		err = p.persistDir(".")
+	}
+	if err != nil {
+		errlog.Println("PersistUpper:", err)
+		os.RemoveAll(staging)
+		return err
+	}
+	stale := filepath.Join(fs.base, PersistStagingName+".old."+randomFilename())
+	if err := os.Rename(fs.TopLayer(), stale); err != nil {
+		os.RemoveAll(staging)
+		return err
+	}
+	if err := os.Rename(staging, fs.TopLayer()); err != nil {
+		errlog.Println("PersistUpper:", err)
+		os.Rename(stale, fs.TopLayer())
+		os.RemoveAll(staging)
+		return err
+	}
+	fs.staleTops = append(fs.staleTops, stale)
+	fs.touchLayerMeta(layerName(fs.layers[0]))
+	return nil
+}
+
+// removeStaleTops removes the top layers replaced by persistUpper(), once
+// they are not mounted.
+func (fs *FileSystem) removeStaleTops() {
+	for _, stale := range fs.staleTops {
+		if err := os.RemoveAll(stale); err != nil {
+			warnlog.Println("removeStaleTops:", err)
+		}
+	}
+	fs.staleTops = nil
+}
+
+// linkTree copies the directory src to dst, with the attributes, including
+// the private extended attributes of overlayfs, and hard links everything
+// other than directories.
+func linkTree(src, dst string) error {
+	attrs, err := readAttrs(src)
+	if err != nil {
+		return err
+	}
+	if err := os.Mkdir(dst, 0700); err != nil {
+		return err
+	}
+	infos, err := ioutil.ReadDir(src)
+	if err != nil {
+		return err
+	}
+	for _, info := range infos {
+		s, d := filepath.Join(src, info.Name()), filepath.Join(dst, info.Name())
+		if info.IsDir() {
+			err = linkTree(s, d)
+		} else {
+			err = os.Link(s, d)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return attrs.restore(dst)
+}
+
+// persister copies the upper directory of overlayfs into the layer directly
+// below it, applying whiteouts and opaque directories.
+type persister struct {
+	upper, lower string
+	userxattr    bool
+
+	// links maps the inodes of hard links in the upper to their copies.
+	links map[uint64]string
+}
+
+func (p *persister) persistDir(relpath string) error {
+	infos, err := ioutil.ReadDir(filepath.Join(p.upper, relpath))
+	if err != nil {
+		return err
+	}
+	for _, info := range infos {
+		rel := filepath.Join(relpath, info.Name())
+		src, dst := filepath.Join(p.upper, rel), filepath.Join(p.lower, rel)
+		tp, err := overlayTypeOf(src, info, nil)
+		if err != nil {
+			return err
+		}
+		dstInfo, dstErr := os.Lstat(dst)
+		switch tp {
+		case overlayTypeWhiteout:
+			if err := os.RemoveAll(dst); err != nil {
+				return err
+			}
+			err = createWhiteout(dst)
+		case overlayTypeOpaque:
+			// an opaque directory hides everything below it.
+			if err := os.RemoveAll(dst); err != nil {
+				return err
+			}
+			if err := os.Mkdir(dst, 0700); err != nil {
+				return err
+			}
+			if err := setOpaque(dst, p.userxattr); err != nil {
+				return err
+			}
+			err = p.persistDirAttrs(rel, src, dst)
+		case overlayTypeDir:
+			if dstErr != nil || !dstInfo.IsDir() {
+				if err := os.RemoveAll(dst); err != nil {
+					return err
+				}
+				if err := os.Mkdir(dst, 0700); err != nil {
+					return err
+				}
+			}
+			err = p.persistDirAttrs(rel, src, dst)
+		default:
+			if err := os.RemoveAll(dst); err != nil {
+				return err
+			}
+			err = p.copyFile(src, dst, info)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// persistDirAttrs persists the directory, and then its attributes, so the
+// modification time is not changed by its entries.
+func (p *persister) persistDirAttrs(rel, src, dst string) error {
+	if err := p.persistDir(rel); err != nil {
+		return err
+	}
+	return copyAttributes(src, dst)
+}
+
+// copyFile copies a file other than a directory, with its attributes.
+func (p *persister) copyFile(src, dst string, info os.FileInfo) error {
+	st := info.Sys().(*syscall.Stat_t)
+	if info.Mode().IsRegular() && st.Nlink > 1 {
+		if first, ok := p.links[st.Ino]; ok {
+			return os.Link(first, dst)
+		}
+		p.links[st.Ino] = dst
+	}
+	var err error
+	switch {
+	case info.Mode().IsRegular():
+		err = copyRegular(src, dst)
+	case info.Mode()&os.ModeSymlink != 0:
+		var target string
+		if target, err = os.Readlink(src); err == nil {
+			err = os.Symlink(target, dst)
+		}
+	default:
+		// devices, named pipes and sockets.
+		err = syscall.Mknod(dst, st.Mode, int(st.Rdev))
+	}
+	if err != nil {
+		return err
+	}
+	return copyAttributes(src, dst)
+}
+
+func copyRegular(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	return writeRegular(dst, in)
+}
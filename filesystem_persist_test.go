@@ -0,0 +1,106 @@
+package ciel
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func newTestPersist(t *testing.T) *FileSystem {
+	t.Helper()
+	fs := newTestFileSystem(t, Layers{"99-top", "00-bottom"}, map[string]testLayerFiles{
+		"top":    {"f", "keep"},
+		"bottom": {"b"},
+	}, false)
+	fs.SetTmpfsUpper(true, "")
+	fs.SetPersistOnUnmount(true)
+	if err := fs.Mount(); err != nil {
+		t.Skip("overlayfs:", err)
+	}
+	t.Cleanup(func() {
+		fs.SetPersistOnUnmount(false)
+		fs.Unmount()
+	})
+	for _, name := range []string{"f", "b"} {
+		if err := os.Remove(filepath.Join(fs.TargetDir(), name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := ioutil.WriteFile(filepath.Join(fs.TargetDir(), "new"), []byte("new"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return fs
+}
+
+// checkPersisted checks the top layer after persisting newTestPersist(), and
+// that nothing is left in the base directory.
+func checkPersisted(t *testing.T, fs *FileSystem) {
+	t.Helper()
+	for _, name := range []string{"new", "keep"} {
+		if !exists(filepath.Join(fs.TopLayer(), name)) {
+			t.Errorf("%s is not in the top layer", name)
+		}
+	}
+	// the top layer is a lower layer of the mount, removing is a whiteout.
+	for _, name := range []string{"f", "b"} {
+		if tp, err := overlayTypeByLstat(filepath.Join(fs.TopLayer(), name)); err != nil || tp != overlayTypeWhiteout {
+			t.Errorf("%s is %q in the top layer, want a whiteout: %v", name, tp, err)
+		}
+	}
+	infos, err := ioutil.ReadDir(fs.base)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, info := range infos {
+		if name := info.Name(); strings.HasPrefix(name, PersistStagingName) || strings.HasPrefix(name, ".ephemeral.") {
+			t.Errorf("%s is left in the base directory", name)
+		}
+	}
+}
+
+func TestPersistOnUnmount(t *testing.T) {
+	fs := newTestPersist(t)
+	// the replaced top layer is kept for the mount until unmounting.
+	if err := fs.PersistUpper(); err != nil {
+		t.Fatal("PersistUpper:", err)
+	}
+	if !exists(filepath.Join(fs.TargetDir(), "keep")) {
+		t.Error("keep is gone from the mount")
+	}
+	if err := fs.Unmount(); err != nil {
+		t.Fatal("Unmount:", err)
+	}
+	checkPersisted(t, fs)
+}
+
+// TestPersistOnUnmountRetry checks that a failed persist leaves the top layer
+// untouched, and keeps the changes for Unmount() to retry.
+func TestPersistOnUnmountRetry(t *testing.T) {
+	fs := newTestPersist(t)
+	upper := fs.scratchUpper()
+	// a redirect is not self-contained, persisting refuses it.
+	if err := lsetxattr(filepath.Join(upper, "new"), "trusted.overlay.redirect", []byte("/f"), 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.Unmount(); err == nil {
+		t.Fatal("Unmount succeeded with a redirect")
+	}
+	if fs.IsMounted() {
+		t.Error("the overlay is still mounted")
+	}
+	if tp, _ := overlayTypeByLstat(filepath.Join(fs.TopLayer(), "f")); tp != overlayTypeFile || exists(filepath.Join(fs.TopLayer(), "new")) {
+		t.Error("the top layer is changed by the failed persist")
+	}
+	if err := fs.Mount(); err != ErrNotPersisted {
+		t.Errorf("Mount: %v, want %v", err, ErrNotPersisted)
+	}
+	if err := lremovexattr(filepath.Join(upper, "new"), "trusted.overlay.redirect"); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.Unmount(); err != nil {
+		t.Fatal("Unmount:", err)
+	}
+	checkPersisted(t, fs)
+}
@@ -0,0 +1,201 @@
+package ciel
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const (
+	UnshareProc       = "unshare"
+	NsenterProc       = "nsenter"
+	FuseOverlayfsProc = "fuse-overlayfs"
+)
+
+// ErrRootless is returned by operations which are not supported in the
+// rootless mode, see SetRootless().
+var ErrRootless = errors.New("not supported in the rootless mode")
+
+// rootlessNS is a process holding a user namespace and a mount namespace,
+// where the file system of a rootless mount is mounted.
+type rootlessNS struct {
+	cmd    *exec.Cmd
+	target string // the mount point in the namespace
+}
+
+// SetRootless makes the file system usable without root. It's mounted in
+// a new user namespace and mount namespace, by overlayfs (Linux 5.11 or
+// later), or by fuse-overlayfs if the kernel refuses it. TargetDir() is then
+// a path in /proc/<pid>/root, which is accessible for the user only.
+// The extended attributes "user.overlay.*" are used, see SetUserXattr().
+//
+// The layers must be owned by the user. Whiteouts are character devices 0/0,
+// which unprivileged users can create since Linux 5.8.
+// Containers run without systemd-nspawn, in new namespaces, and they are
+// never booted. It will go into effect at the next mount.
+func (fs *FileSystem) SetRootless(enable bool) {
+	fs.rootless = enable
+	if enable {
+		fs.overlay.UserXattr = true
+	}
+}
+
+// IsRootless returns whether the file system is in the rootless mode.
+func (fs *FileSystem) IsRootless() bool {
+	fs.lock.RLock()
+	defer fs.lock.RUnlock()
+	return fs.rootless
+}
+
+// mountRootless mounts the file system at target in a new namespace,
+// and returns the path of the mount point for other processes.
+func (fs *FileSystem) mountRootless(target string, rw bool, upperdir string, workdir string, lowerdirs []string) (string, error) {
+	ns, err := newRootlessNS(target)
+	if err != nil {
+		return "", err
+	}
+	if !rw {
+		lowerdirs = append([]string{upperdir}, lowerdirs...)
+		upperdir, workdir = "", ""
+	}
+
+	var nsenterArgs []string
+	option := overlayMountData(upperdir, workdir, lowerdirs, fs.overlay.mountOptions(rw))
+	if len(option) > mountDataLimit() {
+		// relative to the base directory, in the namespace.
+		rel := func(p string) string {
+			if r, err := filepath.Rel(fs.base, p); err == nil {
+				return r
+			}
+			return p
+		}
+		relLowerdirs := make([]string, len(lowerdirs))
+		for i, lowerdir := range lowerdirs {
+			relLowerdirs[i] = rel(lowerdir)
+		}
+		if upperdir != "" {
+			upperdir, workdir = rel(upperdir), rel(workdir)
+		}
+		lowerdirs = relLowerdirs
+		option = overlayMountData(upperdir, workdir, lowerdirs, fs.overlay.mountOptions(rw))
+		nsenterArgs = append(nsenterArgs, "--wdns="+fs.base)
+	}
+
+	infolog.Println("mount (rootless)", target)
+	err = ns.run(nsenterArgs, "mount", "-t", "overlay", "overlay", "-o", option, target)
+	if err != nil {
+		warnlog.Println("mountRootless: overlayfs:", err)
+		if _, e := exec.LookPath(FuseOverlayfsProc); e != nil {
+			ns.kill()
+			return "", err
+		}
+		// fuse-overlayfs does not know the options of overlayfs.
+		option = overlayMountData(upperdir, workdir, lowerdirs, nil)
+		if err := ns.run(nsenterArgs, FuseOverlayfsProc, "-o", option, target); err != nil {
+			errlog.Println("mountRootless: fuse-overlayfs:", err)
+			ns.kill()
+			return "", err
+		}
+	}
+
+	// the container can't create devices, so it uses the ones of the host.
+	if info, err := os.Stat(filepath.Join(ns.hostPath(), "dev")); err == nil && info.IsDir() {
+		if err := ns.run(nil, "mount", "--rbind", "/dev", filepath.Join(target, "dev")); err != nil {
+			warnlog.Println("mountRootless: /dev:", err)
+		}
+	}
+	fs.rootlessNS = ns
+	return ns.hostPath(), nil
+}
+
+// unmountRootless unmounts the file system by killing the namespace.
+func (fs *FileSystem) unmountRootless() error {
+	ns := fs.rootlessNS
+	infolog.Println("umount (rootless)", ns.target)
+	ns.kill()
+	fs.rootlessNS = nil
+	return os.Remove(ns.target)
+}
+
+// rootlessCommand returns the arguments of nsenter, running the command in
+// the mounted file system, with new namespaces of PID, IPC and UTS.
+func (fs *FileSystem) rootlessCommand(proc string, args ...string) []string {
+	fs.lock.RLock()
+	defer fs.lock.RUnlock()
+	return append(append(fs.rootlessNS.nsenterArgs(), "--",
+		UnshareProc, "--pid", "--fork", "--mount", "--ipc", "--uts",
+		"--root="+fs.rootlessNS.target, "--mount-proc", "--", proc), args...)
+}
+
+func newRootlessNS(target string) (*rootlessNS, error) {
+	cmd := exec.Command(UnshareProc, "--user", "--map-root-user", "--mount",
+		"--propagation", "private", "--", "sleep", "infinity")
+	cmd.SysProcAttr = &syscall.SysProcAttr{Pdeathsig: syscall.SIGKILL}
+	dbglog.Println("newRootlessNS:", cmd.Args)
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+	ns := &rootlessNS{cmd: cmd, target: target}
+
+	// the namespaces are ready when unshare runs the command.
+	comm := fmt.Sprintf("/proc/%d/comm", cmd.Process.Pid)
+	for i := 0; ; i++ {
+		b, err := ioutil.ReadFile(comm)
+		if err != nil {
+			ns.kill()
+			return nil, err
+		}
+		if strings.TrimSpace(string(b)) == "sleep" {
+			break
+		}
+		if i == 500 {
+			ns.kill()
+			return nil, errors.New("newRootlessNS: timed out")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return ns, nil
+}
+
+func (ns *rootlessNS) nsenterArgs() []string {
+	return []string{"--target", strconv.Itoa(ns.cmd.Process.Pid),
+		"--user", "--mount", "--preserve-credentials"}
+}
+
+// run runs the command in the namespace.
+func (ns *rootlessNS) run(nsenterArgs []string, proc string, args ...string) error {
+	all := append(append(append(ns.nsenterArgs(), nsenterArgs...), "--", proc), args...)
+	dbglog.Println("rootlessNS.run:", all)
+	out, err := exec.Command(NsenterProc, all...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%s: %v: %s", proc, err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// hostPath is the path of the mount point, for the processes of the user
+// outside of the namespace.
+func (ns *rootlessNS) hostPath() string {
+	return fmt.Sprintf("/proc/%d/root%s", ns.cmd.Process.Pid, ns.target)
+}
+
+func (ns *rootlessNS) kill() {
+	ns.cmd.Process.Kill()
+	ns.cmd.Wait()
+}
+
+// removeWorkDir removes a work directory of overlayfs. In a user namespace,
+// overlayfs leaves directories inaccessible even for the owner.
+func removeWorkDir(path string) error {
+	for _, dir := range []string{"work", "index"} {
+		os.Chmod(filepath.Join(path, dir), 0700)
+	}
+	return os.RemoveAll(path)
+}
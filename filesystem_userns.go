@@ -0,0 +1,149 @@
+package ciel
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+// ErrOwnershipShifted is returned by MergeFile() when the ownership of the
+// layers is shifted differently, by "systemd-nspawn --private-users-ownership=chown".
+var ErrOwnershipShifted = errors.New("the ownership of the layers is shifted differently, see ShiftOwnership()")
+
+const (
+	// userNSRange is the size of the UID/GID range of a container.
+	// systemd-nspawn aligns the ranges it picks to it.
+	userNSRange = 0x10000
+	// userNSPickFirst is the first UID of the ranges systemd-nspawn picks,
+	// lower UIDs belong to the host.
+	userNSPickFirst = 0x80000
+)
+
+// OwnershipShift returns the first UID of the range a layer is shifted to,
+// or 0 if it's not shifted. The shift is recorded in the metadata of the top
+// layer when a container runs with the ownership "chown", see PrivateUsers.
+// Otherwise it's guessed from the owner of the root directory of the layer,
+// like systemd-nspawn determines it, if it's in the ranges systemd-nspawn
+// picks. Layers are never shifted in the rootless mode.
+func (fs *FileSystem) OwnershipShift(layer string) (uint32, error) {
+	if fs.rootless {
+		return 0, nil
+	}
+	meta, err := fs.LayerMeta(layer)
+	if err != nil {
+		return 0, err
+	} else if meta.Shift != 0 {
+		return meta.Shift, nil
+	}
+	info, err := os.Lstat(fs.Layer(layer))
+	if os.IsNotExist(err) {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+	uid := info.Sys().(*syscall.Stat_t).Uid
+	if uid < userNSPickFirst {
+		return 0, nil
+	}
+	return uid &^ (userNSRange - 1), nil
+}
+
+// recordOwnershipShift records the range the top layer is shifted to by a
+// container, which is the range of the owner of the root directory of the
+// mount. Ephemeral and tmpfs-backed mounts don't change the top layer.
+func (fs *FileSystem) recordOwnershipShift() {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+	if !fs.mounted || fs.scratch != "" || fs.rootless {
+		return
+	}
+	info, err := os.Lstat(fs.target)
+	if err != nil {
+		warnlog.Println("recordOwnershipShift:", err)
+		return
+	}
+	fs.setOwnershipShift(layerName(fs.layers[0]), info.Sys().(*syscall.Stat_t).Uid&^(userNSRange-1))
+}
+
+// setOwnershipShift writes the shift of a layer into its metadata.
+func (fs *FileSystem) setOwnershipShift(layer string, shift uint32) {
+	meta, err := fs.LayerMeta(layer)
+	if err != nil {
+		warnlog.Println("setOwnershipShift:", err)
+		return
+	}
+	if meta.Shift == shift {
+		return
+	}
+	meta.Shift = shift
+	if err := fs.writeLayerMeta(meta); err != nil {
+		warnlog.Println("setOwnershipShift:", err)
+	}
+}
+
+// ShiftOwnership changes the ownership of all files in a layer from its
+// current range to the range starting at shift. ShiftOwnership(layer, 0)
+// makes a layer shifted by a container portable again.
+func (fs *FileSystem) ShiftOwnership(layer string, shift uint32) error {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+	if err := fs.checkLayersChangeable(); err != nil {
+		return err
+	}
+	if shift%userNSRange != 0 {
+		return fmt.Errorf("ShiftOwnership: %#x is not aligned to %#x", shift, userNSRange)
+	}
+	current, err := fs.OwnershipShift(layer)
+	if err != nil || current == shift {
+		return err
+	}
+	infolog.Printf("shift ownership of %s: %#x -> %#x\n", layer, current, shift)
+	err = filepath.Walk(fs.Layer(layer), func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		attrs, err := readAttrs(path)
+		if err != nil {
+			return err
+		}
+		attrs.UID = int(shiftID(uint32(attrs.UID), current, shift))
+		attrs.GID = int(shiftID(uint32(attrs.GID), current, shift))
+		// it restores the mode and capabilities, which are cleared by chown().
+		return attrs.apply(path, true)
+	})
+	if err != nil {
+		errlog.Println("ShiftOwnership:", err)
+		return err
+	}
+	fs.setOwnershipShift(layer, shift)
+	fs.touchLayerMeta(layer)
+	return nil
+}
+
+// checkSameShift makes sure that files can be moved between the layers
+// without changing their ownership.
+func (fs *FileSystem) checkSameShift(upper, lower string) error {
+	ushift, err := fs.OwnershipShift(upper)
+	if err != nil {
+		return err
+	}
+	lshift, err := fs.OwnershipShift(lower)
+	if err != nil {
+		return err
+	}
+	if ushift != lshift {
+		return ErrOwnershipShifted
+	}
+	return nil
+}
+
+// shiftID moves an ID in the range starting at from to the range starting
+// at to. IDs out of the range are not changed.
+func shiftID(id, from, to uint32) uint32 {
+	if id < from || id >= from+userNSRange {
+		return id
+	}
+	return id - from + to
+}
@@ -0,0 +1,134 @@
+package ciel
+
+import (
+	"os"
+	"syscall"
+	"testing"
+)
+
+func TestOwnershipShift(t *testing.T) {
+	tests := []struct {
+		name     string
+		uid      int
+		recorded uint32
+		rootless bool
+		want     uint32
+	}{
+		{name: "not shifted", uid: 0, want: 0},
+		{name: "host user", uid: 1000, want: 0},
+		{name: "below the picked ranges", uid: 0x7ffff, want: 0},
+		{name: "picked range", uid: 0x90000, want: 0x90000},
+		{name: "unaligned owner", uid: 0x90012, want: 0x90000},
+		{name: "recorded", uid: 0x10000, recorded: 0x10000, want: 0x10000},
+		{name: "rootless", uid: 0x90000, rootless: true, want: 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fs := newTestFileSystem(t, Layers{"99-top", "00-bottom"}, nil, false)
+			fs.rootless = tt.rootless
+			if err := os.Lchown(fs.Layer("top"), tt.uid, tt.uid); err != nil {
+				t.Fatal(err)
+			}
+			if tt.recorded != 0 {
+				fs.setOwnershipShift("top", tt.recorded)
+			}
+			got, err := fs.OwnershipShift("top")
+			if err != nil {
+				t.Fatal("OwnershipShift:", err)
+			}
+			if got != tt.want {
+				t.Errorf("OwnershipShift = %#x, want %#x", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestShiftOwnershipRecorded(t *testing.T) {
+	fs := newTestFileSystem(t, Layers{"99-top", "00-bottom"}, map[string]testLayerFiles{
+		"top": {"f"},
+	}, false)
+	if err := os.Lchown(fs.Layer("top"), 0x10000, 0x10000); err != nil {
+		t.Fatal(err)
+	}
+	fs.setOwnershipShift("top", 0x10000)
+	if err := fs.ShiftOwnership("top", 0); err != nil {
+		t.Fatal("ShiftOwnership:", err)
+	}
+	if meta, err := fs.LayerMeta("top"); err != nil {
+		t.Fatal(err)
+	} else if meta.Shift != 0 {
+		t.Errorf("the recorded shift is %#x, want 0", meta.Shift)
+	}
+	info, err := os.Lstat(fs.Layer("top"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if uid := info.Sys().(*syscall.Stat_t).Uid; uid != 0 {
+		t.Errorf("the owner of the root is %d, want 0", uid)
+	}
+}
+
+// TestRecordOwnershipShift checks that the range of the owner of the mounted
+// root is recorded, for fixed ranges below the ones systemd-nspawn picks.
+func TestRecordOwnershipShift(t *testing.T) {
+	fs := newTestFileSystem(t, Layers{"99-top", "00-bottom"}, nil, false)
+	if err := fs.Mount(); err != nil {
+		t.Skip("overlayfs:", err)
+	}
+	defer fs.Unmount()
+	// like "--private-users=65536:65536 --private-users-ownership=chown".
+	if err := os.Lchown(fs.TargetDir(), 0x10000, 0x10000); err != nil {
+		t.Fatal(err)
+	}
+	fs.recordOwnershipShift()
+	if got, err := fs.OwnershipShift("top"); err != nil {
+		t.Fatal("OwnershipShift:", err)
+	} else if got != 0x10000 {
+		t.Errorf("OwnershipShift = %#x, want 0x10000", got)
+	}
+}
+
+// TestCommitOwnershipShift checks that the recorded shift moves with the
+// committed files, and is cleared by Reset().
+func TestCommitOwnershipShift(t *testing.T) {
+	fs := newTestFileSystem(t, Layers{"99-top", "00-bottom"}, map[string]testLayerFiles{
+		"top": {"f"},
+	}, false)
+	chown := func() {
+		t.Helper()
+		if err := os.Lchown(fs.Layer("top"), 0x10000, 0x10000); err != nil {
+			t.Fatal(err)
+		}
+		fs.setOwnershipShift("top", 0x10000)
+	}
+	wantShift := func(layer string, want uint32) {
+		t.Helper()
+		if got, err := fs.OwnershipShift(layer); err != nil {
+			t.Fatal("OwnershipShift:", err)
+		} else if got != want {
+			t.Errorf("OwnershipShift(%q) = %#x, want %#x", layer, got, want)
+		}
+	}
+
+	chown()
+	if err := fs.Commit("built"); err != nil {
+		t.Fatal("Commit:", err)
+	}
+	wantShift("built", 0x10000)
+	wantShift("top", 0)
+
+	// the container runs again on the committed layer.
+	chown()
+	if err := createTestFile(fs.Layer("top"), "g", false); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.MergeFile("/g", "top", "built", false); err != nil {
+		t.Fatal("MergeFile:", err)
+	}
+
+	if err := fs.Reset(); err != nil {
+		t.Fatal("Reset:", err)
+	}
+	wantShift("top", 0)
+	wantShift("built", 0x10000)
+}
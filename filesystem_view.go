@@ -0,0 +1,235 @@
+package ciel
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Resolution describes how a path in the merged view is composed of layers.
+type Resolution struct {
+	// Layer is the name of the layer providing the path, or the layer hiding
+	// it when Hidden is true. It is a null string if no layer has the path.
+	Layer string
+
+	// Hidden is true when the path is covered by a whiteout, or by a
+	// non-directory parent in Layer.
+	Hidden bool
+
+	// Shadowed lists the lower layers having their own version of the path,
+	// from top to bottom. They are invisible in the merged view.
+	// For directories, only the attributes are shadowed, their contents are merged.
+	Shadowed []string
+}
+
+// Resolve returns the layer which provides the path in the merged view, and
+// the lower layers whose versions are shadowed. Disabled layers are ignored.
+func (fs *FileSystem) Resolve(path string) (Resolution, error) {
+	var res Resolution
+	chain, err := fs.lookup(relPath(path), 0, len(fs.layers)-1, true)
+	if err != nil || len(chain) == 0 {
+		return res, err
+	}
+	res.Layer = layerName(fs.layers[chain[0].index])
+	res.Hidden = chain[0].covered || chain[0].tp == overlayTypeWhiteout
+	for _, e := range chain[1:] {
+		if e.covered || e.tp == overlayTypeWhiteout {
+			continue
+		}
+		res.Shadowed = append(res.Shadowed, layerName(fs.layers[e.index]))
+	}
+	return res, nil
+}
+
+// layerEntry is a path found in a single layer.
+type layerEntry struct {
+	index int
+	tp    overlayType
+	info  os.FileInfo
+
+	// covered is true if the path itself does not exist in the layer,
+	// but one of its parents covers it.
+	covered bool
+}
+
+// lookup collects the layers in [lbound, ubound] having an effect on relpath,
+// from top to bottom. The first entry, if any, is the one visible in the merged
+// view of that range. If masked is true, disabled layers are skipped.
+func (fs *FileSystem) lookup(relpath string, lbound, ubound int, masked bool) ([]layerEntry, error) {
+	var chain []layerEntry
+	parents := parentPaths(relpath)
+	for i := lbound; i <= ubound; i++ {
+		if masked && i != 0 && !fs.layersMask[i] {
+			continue
+		}
+		iroot := filepath.Join(fs.base, fs.layers[i])
+
+		// an opaque parent hides the path in lower layers,
+		// even if the path does not exist in this layer.
+		covered, absent, opaque := false, false, false
+		for _, p := range parents {
+			ptp, err := overlayTypeByLstat(filepath.Join(iroot, p))
+			if err != nil {
+				return nil, err
+			}
+			if ptp == overlayTypeAir {
+				absent = true
+				break
+			}
+			if ptp == overlayTypeOpaque {
+				opaque = true
+			} else if ptp != overlayTypeDir {
+				covered = true
+				break
+			}
+		}
+		if covered || (absent && opaque) {
+			chain = append(chain, layerEntry{index: i, tp: overlayTypeWhiteout, covered: true})
+			continue
+		}
+		if absent {
+			continue
+		}
+
+		ipath := filepath.Join(iroot, relpath)
+		info, err := os.Lstat(ipath)
+		itp, err := overlayTypeOf(ipath, info, err)
+		if err != nil {
+			return nil, err
+		}
+		if itp == overlayTypeAir {
+			if opaque {
+				chain = append(chain, layerEntry{index: i, tp: overlayTypeWhiteout, covered: true})
+			}
+			continue
+		}
+		chain = append(chain, layerEntry{index: i, tp: itp, info: info})
+	}
+	return chain, nil
+}
+
+// layerName returns the name of a layer without its number prefix.
+//
+// Example: layerName("50-custom") returns "custom"
+func layerName(fullname string) string {
+	fullnameSlice := strings.SplitN(fullname, "-", 2)
+	if len(fullnameSlice) != 2 {
+		return fullname
+	}
+	return fullnameSlice[1]
+}
+
+// relPath cleans a path in the merged view and makes it relative to the root.
+func relPath(path string) string {
+	rel := strings.TrimPrefix(filepath.Clean("/"+path), "/")
+	if rel == "" {
+		return "."
+	}
+	return rel
+}
+
+// parentPaths returns all parent directories of a relative path, from the
+// outermost one. The root itself is not included.
+func parentPaths(relpath string) []string {
+	var parents []string
+	dir := filepath.Dir(relpath)
+	for dir != "." && dir != "/" {
+		parents = append([]string{dir}, parents...)
+		dir = filepath.Dir(dir)
+	}
+	return parents
+}
+
+// walkMerged walks the merged view of layers in [lbound, ubound] like
+// filepath.Walk(), in lexical order, calling fn with the entry providing each
+// path. The root itself is not walked. If masked is true, disabled layers are skipped.
+func (fs *FileSystem) walkMerged(lbound, ubound int, masked bool, fn func(relpath string, e layerEntry) error) error {
+	var roots []int
+	for i := lbound; i <= ubound; i++ {
+		if masked && i != 0 && !fs.layersMask[i] {
+			continue
+		}
+		roots = append(roots, i)
+	}
+	return fs.walkMergedDir(".", roots, fn)
+}
+
+// walkMergedDir walks the directory relpath, merged from the layers,
+// which must be sorted from top to bottom.
+func (fs *FileSystem) walkMergedDir(relpath string, layers []int, fn func(relpath string, e layerEntry) error) error {
+	entries := make(map[string]layerEntry)
+	for _, i := range layers {
+		ipath := filepath.Join(fs.base, fs.layers[i], relpath)
+		dir, err := os.Open(ipath)
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return err
+		}
+		infos, err := dir.Readdir(0) // 0: check all sub-files
+		dir.Close()
+		if err != nil {
+			return err
+		}
+		for _, info := range infos {
+			if _, ok := entries[info.Name()]; ok {
+				continue
+			}
+			tp, err := overlayTypeOf(filepath.Join(ipath, info.Name()), info, nil)
+			if err != nil {
+				return err
+			}
+			entries[info.Name()] = layerEntry{index: i, tp: tp, info: info}
+		}
+	}
+
+	names := make([]string, 0, len(entries))
+	for name, e := range entries {
+		if e.tp != overlayTypeWhiteout {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		e := entries[name]
+		rel := filepath.Join(relpath, name)
+		if err := fn(rel, e); err != nil {
+			return err
+		}
+		if e.tp != overlayTypeDir && e.tp != overlayTypeOpaque {
+			continue
+		}
+
+		// the directory is merged with directories in lower layers,
+		// until one of them is covered, or it's opaque.
+		sublayers := []int{e.index}
+		for _, i := range layers {
+			if e.tp == overlayTypeOpaque {
+				break
+			}
+			if i <= e.index {
+				continue
+			}
+			itp, err := overlayTypeByLstat(filepath.Join(fs.base, fs.layers[i], rel))
+			if err != nil {
+				return err
+			}
+			if itp == overlayTypeAir {
+				continue
+			}
+			if itp != overlayTypeDir && itp != overlayTypeOpaque {
+				break
+			}
+			sublayers = append(sublayers, i)
+			if itp == overlayTypeOpaque {
+				break
+			}
+		}
+		if err := fs.walkMergedDir(rel, sublayers, fn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,135 @@
+package ciel
+
+import (
+	"os"
+	"strings"
+	"syscall"
+	"unsafe"
+)
+
+// The new mount API of Linux (5.2 or later). The numbers of the system calls
+// are the same on all architectures.
+const (
+	sysMoveMount = 429
+	sysFsopen    = 430
+	sysFsconfig  = 431
+	sysFsmount   = 432
+
+	fsopenCloexec       = 0x1
+	fsconfigSetFlag     = 0
+	fsconfigSetString   = 1
+	fsconfigCmdCreate   = 6
+	fsmountCloexec      = 0x1
+	moveMountFEmptyPath = 0x4
+	atFdcwd             = -0x64
+)
+
+// fsMountNewAPI mounts overlayfs with fsopen(2) and fsconfig(2), which takes
+// the lower directories one by one ("lowerdir+", Linux 6.8 or later), so the
+// number of layers is not limited by the size of a page.
+func fsMountNewAPI(path string, upperdir string, workdir string, lowerdirs []string, opts []string) error {
+	dbglog.Println("fsMountNewAPI: <=", path, lowerdirs, upperdir, workdir, opts)
+	fsfd, err := fsopen("overlay")
+	if err != nil {
+		return err
+	}
+	defer syscall.Close(fsfd)
+
+	for _, lowerdir := range lowerdirs {
+		if err := fsconfigString(fsfd, "lowerdir+", lowerdir); err != nil {
+			return err
+		}
+	}
+	if upperdir != "" {
+		if err := fsconfigString(fsfd, "upperdir", upperdir); err != nil {
+			return err
+		}
+		if err := fsconfigString(fsfd, "workdir", workdir); err != nil {
+			return err
+		}
+	}
+	for _, opt := range opts {
+		kv := strings.SplitN(opt, "=", 2)
+		if len(kv) == 2 {
+			err = fsconfigString(fsfd, kv[0], kv[1])
+		} else {
+			err = fsconfig(fsfd, fsconfigSetFlag, kv[0], "")
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if err := fsconfig(fsfd, fsconfigCmdCreate, "", ""); err != nil {
+		return err
+	}
+
+	mfd, err := fsmount(fsfd)
+	if err != nil {
+		return err
+	}
+	defer syscall.Close(mfd)
+	return moveMount(mfd, path)
+}
+
+func fsopen(fstype string) (int, error) {
+	p, err := syscall.BytePtrFromString(fstype)
+	if err != nil {
+		return -1, err
+	}
+	fd, _, e1 := syscall.Syscall(sysFsopen, uintptr(unsafe.Pointer(p)), fsopenCloexec, 0)
+	if e1 != 0 {
+		return -1, os.NewSyscallError("fsopen", e1)
+	}
+	return int(fd), nil
+}
+
+func fsconfigString(fd int, key, value string) error {
+	return fsconfig(fd, fsconfigSetString, key, value)
+}
+
+func fsconfig(fd int, cmd int, key, value string) error {
+	var k, v *byte
+	var err error
+	if key != "" {
+		if k, err = syscall.BytePtrFromString(key); err != nil {
+			return err
+		}
+	}
+	if cmd == fsconfigSetString {
+		if v, err = syscall.BytePtrFromString(value); err != nil {
+			return err
+		}
+	}
+	_, _, e1 := syscall.Syscall6(sysFsconfig, uintptr(fd), uintptr(cmd),
+		uintptr(unsafe.Pointer(k)), uintptr(unsafe.Pointer(v)), 0, 0)
+	if e1 != 0 {
+		return os.NewSyscallError("fsconfig "+key, e1)
+	}
+	return nil
+}
+
+func fsmount(fsfd int) (int, error) {
+	fd, _, e1 := syscall.Syscall(sysFsmount, uintptr(fsfd), fsmountCloexec, 0)
+	if e1 != 0 {
+		return -1, os.NewSyscallError("fsmount", e1)
+	}
+	return int(fd), nil
+}
+
+func moveMount(mfd int, target string) error {
+	empty, err := syscall.BytePtrFromString("")
+	if err != nil {
+		return err
+	}
+	p, err := syscall.BytePtrFromString(target)
+	if err != nil {
+		return err
+	}
+	fdcwd := atFdcwd
+	_, _, e1 := syscall.Syscall6(sysMoveMount, uintptr(mfd), uintptr(unsafe.Pointer(empty)),
+		uintptr(fdcwd), uintptr(unsafe.Pointer(p)), moveMountFEmptyPath, 0)
+	if e1 != 0 {
+		return os.NewSyscallError("move_mount", e1)
+	}
+	return nil
+}
@@ -0,0 +1,249 @@
+package ciel
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+)
+
+// Media types of OCI (and Docker) images, which ImportOCI() cares about.
+const (
+	ociMediaTypeIndex      = "application/vnd.oci.image.index.v1+json"
+	dockerMediaTypeList    = "application/vnd.docker.distribution.manifest.list.v2+json"
+	ociRefNameAnnotation   = "org.opencontainers.image.ref.name"
+	ociImportTopLayer      = "upper"
+	ociImportLayerNameSize = 12
+)
+
+type ociDescriptor struct {
+	MediaType   string            `json:"mediaType"`
+	Digest      string            `json:"digest"`
+	Size        int64             `json:"size"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+	Platform    *struct {
+		Architecture string `json:"architecture"`
+		OS           string `json:"os"`
+	} `json:"platform,omitempty"`
+}
+
+type ociIndex struct {
+	MediaType string          `json:"mediaType"`
+	Manifests []ociDescriptor `json:"manifests"`
+}
+
+type ociManifest struct {
+	MediaType string          `json:"mediaType"`
+	Layers    []ociDescriptor `json:"layers"`
+}
+
+// ImportOCI extracts the layers of an image in the OCI layout directory
+// layoutDir into new layer directories in baseDir, and returns the layers
+// for New(), eg. ["99-upper", "66-<digest>", "33-<digest>", "00-<digest>"].
+// The layers are named after the first hexadecimal digits of their digests,
+// with an empty top layer "upper". Whiteouts and opaque directories in the
+// image layers are converted to overlayfs ones.
+//
+// ref selects the image by its "org.opencontainers.image.ref.name" annotation,
+// eg. "latest". If ref is empty, the only image, or the image for the current
+// platform is selected.
+//
+// If rootless is true, the layers are extracted for FileSystem.SetRootless():
+// opaque directories have "user.overlay.*" extended attributes, and the files
+// are owned by the user, like ImportRootfs() does in the rootless mode.
+func ImportOCI(layoutDir, ref, baseDir string, rootless bool) (Layers, error) {
+	m, err := readOCIManifest(layoutDir, ref)
+	if err != nil {
+		return nil, err
+	}
+	if len(m.Layers) == 0 {
+		return nil, errors.New("ImportOCI: the image has no layers")
+	}
+	layers, err := ociLayerNames(m.Layers)
+	if err != nil {
+		return nil, err
+	}
+	for _, fullname := range layers {
+		if exists(filepath.Join(baseDir, fullname)) {
+			return nil, fmt.Errorf("ImportOCI: layer %q exists", fullname)
+		}
+	}
+
+	fs := newFileSystem(baseDir, layers)
+	fs.SetRootless(rootless)
+	var created []string
+	cleanup := func() {
+		for _, dir := range created {
+			os.RemoveAll(dir)
+		}
+	}
+	for i, fullname := range layers {
+		dir := filepath.Join(baseDir, fullname)
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			cleanup()
+			return nil, err
+		}
+		created = append(created, dir)
+		if i == 0 {
+			continue
+		}
+		// layers in the manifest are from bottom to top.
+		desc := m.Layers[len(m.Layers)-i]
+		infolog.Println("ImportOCI: extracting", desc.Digest, "->", fullname)
+		if err := extractOCILayer(layoutDir, desc, dir, fs.overlay.UserXattr, fs.rootless); err != nil {
+			cleanup()
+			return nil, fmt.Errorf("ImportOCI: layer %s: %v", desc.Digest, err)
+		}
+	}
+	for i := len(layers) - 1; i >= 1; i-- {
+		fs.createLayerMeta(i, "import-oci", "OCI layer "+m.Layers[len(m.Layers)-i].Digest)
+	}
+	fs.createLayerMeta(0, "import-oci", "")
+	return layers, nil
+}
+
+// readOCIManifest finds the manifest of the image in the layout.
+func readOCIManifest(layoutDir, ref string) (*ociManifest, error) {
+	var index ociIndex
+	b, err := ioutil.ReadFile(filepath.Join(layoutDir, "index.json"))
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(b, &index); err != nil {
+		return nil, fmt.Errorf("index.json: %v", err)
+	}
+	desc, err := selectOCIManifest(index.Manifests, ref)
+	if err != nil {
+		return nil, err
+	}
+	// a multi-platform image has an index of manifests.
+	for desc.MediaType == ociMediaTypeIndex || desc.MediaType == dockerMediaTypeList {
+		b, err := readOCIBlob(layoutDir, desc)
+		if err != nil {
+			return nil, err
+		}
+		var nested ociIndex
+		if err := json.Unmarshal(b, &nested); err != nil {
+			return nil, fmt.Errorf("%s: %v", desc.Digest, err)
+		}
+		if desc, err = selectOCIManifest(nested.Manifests, ""); err != nil {
+			return nil, err
+		}
+	}
+	b, err = readOCIBlob(layoutDir, desc)
+	if err != nil {
+		return nil, err
+	}
+	var m ociManifest
+	if err := json.Unmarshal(b, &m); err != nil {
+		return nil, fmt.Errorf("%s: %v", desc.Digest, err)
+	}
+	return &m, nil
+}
+
+func selectOCIManifest(manifests []ociDescriptor, ref string) (ociDescriptor, error) {
+	if ref != "" {
+		for _, desc := range manifests {
+			if desc.Annotations[ociRefNameAnnotation] == ref {
+				return desc, nil
+			}
+		}
+		return ociDescriptor{}, fmt.Errorf("no image %q in the OCI layout", ref)
+	}
+	if len(manifests) == 1 {
+		return manifests[0], nil
+	}
+	for _, desc := range manifests {
+		if p := desc.Platform; p != nil && p.OS == runtime.GOOS && p.Architecture == runtime.GOARCH {
+			return desc, nil
+		}
+	}
+	return ociDescriptor{}, errors.New("no image selected in the OCI layout")
+}
+
+// ociBlobPath returns the path of a blob in the layout, eg.
+// "blobs/sha256/0123...".
+func ociBlobPath(layoutDir, digest string) (string, error) {
+	fields := strings.SplitN(digest, ":", 2)
+	if len(fields) != 2 || fields[0] != "sha256" || len(fields[1]) != sha256.Size*2 ||
+		strings.Trim(fields[1], "0123456789abcdef") != "" {
+		return "", fmt.Errorf("unsupported digest: %q", digest)
+	}
+	return filepath.Join(layoutDir, "blobs", fields[0], fields[1]), nil
+}
+
+// readOCIBlob reads a small blob, like a manifest, and verifies it.
+func readOCIBlob(layoutDir string, desc ociDescriptor) ([]byte, error) {
+	path, err := ociBlobPath(layoutDir, desc.Digest)
+	if err != nil {
+		return nil, err
+	}
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if digest := fmt.Sprintf("sha256:%x", sha256.Sum256(b)); digest != desc.Digest {
+		return nil, fmt.Errorf("blob %s is corrupted", desc.Digest)
+	}
+	return b, nil
+}
+
+// extractOCILayer extracts the (compressed) tarball of a layer into dir,
+// verifying its digest.
+func extractOCILayer(layoutDir string, desc ociDescriptor, dir string, userxattr, rootless bool) error {
+	path, err := ociBlobPath(layoutDir, desc.Digest)
+	if err != nil {
+		return err
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	h := sha256.New()
+	x := newTarExtractor(dir)
+	x.oci, x.userxattr, x.rootless = true, userxattr, rootless
+	if err := x.extractCompressed(io.TeeReader(f, h)); err != nil {
+		return err
+	}
+	// the padding after the end of the archive is hashed too.
+	if _, err := io.Copy(h, f); err != nil {
+		return err
+	}
+	if digest := fmt.Sprintf("sha256:%x", h.Sum(nil)); digest != desc.Digest {
+		return fmt.Errorf("blob %s is corrupted", desc.Digest)
+	}
+	return nil
+}
+
+// ociLayerNames names the layers, from top to bottom, with numbers spread
+// evenly like renumberLayers().
+func ociLayerNames(descs []ociDescriptor) (Layers, error) {
+	n := len(descs)
+	width, max := 2, 100
+	for (max-1)/n < 2 {
+		max *= 10
+		width++
+	}
+	step := (max - 1) / n
+	layers := Layers{fmt.Sprintf("%0*d-%s", width, max-1, ociImportTopLayer)}
+	used := map[string]int{ociImportTopLayer: 1}
+	for i := n - 1; i >= 0; i-- {
+		if _, err := ociBlobPath("", descs[i].Digest); err != nil {
+			return nil, err
+		}
+		name := strings.TrimPrefix(descs[i].Digest, "sha256:")[:ociImportLayerNameSize]
+		// the same layer may appear more than once in an image.
+		if used[name]++; used[name] > 1 {
+			name = fmt.Sprintf("%s.%d", name, used[name])
+		}
+		layers = append(layers, fmt.Sprintf("%0*d-%s", width, max-1-(n-i)*step, name))
+	}
+	return layers, nil
+}
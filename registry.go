@@ -0,0 +1,476 @@
+package ciel
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+// ErrNoContainer is returned by Registry when there is no container of the name.
+var ErrNoContainer = errors.New("no such container in the registry")
+
+// ContainerDef is the definition of a container, persisted by Registry.
+type ContainerDef struct {
+	Name     string   `json:"name"`
+	BaseDir  string   `json:"base_dir"`
+	Layers   Layers   `json:"layers"`
+	Disabled []string `json:"disabled,omitempty"` // the disabled layers
+
+	Boot         bool         `json:"boot"` // see Container.SetPreference()
+	Properties   []string     `json:"properties,omitempty"`
+	PrivateUsers PrivateUsers `json:"private_users"`
+	ReadOnly     bool         `json:"read_only,omitempty"`
+	Volatile     bool         `json:"volatile,omitempty"`
+
+	Mount MountDef `json:"mount"`
+}
+
+// MountDef is how the file system of a container is mounted.
+type MountDef struct {
+	Ephemeral  bool           `json:"ephemeral,omitempty"`
+	TmpfsUpper bool           `json:"tmpfs_upper,omitempty"`
+	TmpfsSize  string         `json:"tmpfs_size,omitempty"`
+	Persist    bool           `json:"persist,omitempty"` // see FileSystem.SetPersistOnUnmount()
+	Rootless   bool           `json:"rootless,omitempty"`
+	Overlay    OverlayOptions `json:"overlay"`
+}
+
+// ContainerStatus is a container in the registry, with its live status.
+type ContainerStatus struct {
+	ContainerDef
+	Mounted    bool   `json:"mounted"`
+	MountPoint string `json:"mount_point,omitempty"`
+	Machine    bool   `json:"machine"` // registered to systemd-machined
+	Booted     bool   `json:"booted"`
+}
+
+// Definition returns the definition of the container, for Registry.
+func (c *Container) Definition() ContainerDef {
+	// the locks are not held together: the file system is locked before the
+	// container by systemdNspawnBoot() and systemdNspawnRun().
+	c.lock.RLock()
+	def := ContainerDef{
+		Name:         c.Name,
+		Boot:         c.boot,
+		Properties:   append([]string{}, c.properties...),
+		PrivateUsers: c.privUsers,
+		ReadOnly:     c.readOnly,
+		Volatile:     c.volatile,
+	}
+	c.lock.RUnlock()
+
+	fs := c.Fs
+	fs.lock.RLock()
+	defer fs.lock.RUnlock()
+	def.BaseDir = fs.base
+	def.Layers = append(Layers{}, fs.layers...)
+	def.Mount = MountDef{
+		Ephemeral:  fs.ephemeral,
+		TmpfsUpper: fs.tmpfsUpper,
+		TmpfsSize:  fs.tmpfsSize,
+		Persist:    fs.persistOnUnmount,
+		Rootless:   fs.rootless,
+		Overlay:    fs.overlay,
+	}
+	for i, enabled := range fs.layersMask {
+		if i != 0 && !enabled {
+			def.Disabled = append(def.Disabled, layerName(fs.layers[i]))
+		}
+	}
+	return def
+}
+
+// container creates a container from the definition.
+func (def ContainerDef) container() (*Container, error) {
+	var opts []Option
+	if def.Mount.Ephemeral {
+		opts = append(opts, WithEphemeral())
+	}
+	if def.ReadOnly {
+		opts = append(opts, WithReadOnly(def.Volatile))
+	}
+	c, err := newContainer(def.Name, def.BaseDir, append(opts, WithLayers(def.Layers)))
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range def.Disabled {
+		if def.Layers.find(name) == -1 {
+			return nil, fmt.Errorf("%s: no such layer: %q", def.Name, name)
+		}
+	}
+	c.Fs.DisableLayer(def.Disabled...)
+	if err := c.Fs.SetOverlayOptions(def.Mount.Overlay); err != nil {
+		return nil, err
+	}
+	c.Fs.SetTmpfsUpper(def.Mount.TmpfsUpper, def.Mount.TmpfsSize)
+	c.Fs.SetPersistOnUnmount(def.Mount.Persist)
+	c.Fs.SetRootless(def.Mount.Rootless)
+	if err := c.SetPrivateUsers(def.PrivateUsers); err != nil {
+		return nil, err
+	}
+	c.SetPreference(def.Boot)
+	c.SetProperties(def.Properties)
+	return c, nil
+}
+
+// Registry persists the definitions of containers in a state file, so they
+// can be listed and reloaded by later processes. The state file is locked
+// while it's changed, and read again by every method, so processes sharing
+// it see the changes of each other.
+type Registry struct {
+	lock sync.Mutex
+	path string
+
+	// live is the containers saved or loaded by this process.
+	live map[string]*Container
+}
+
+// registryState is the content of the state file.
+type registryState struct {
+	Containers []ContainerDef `json:"containers"`
+}
+
+// OpenRegistry opens the registry with the state file at path. The file is
+// created by the first Save().
+func OpenRegistry(path string) (*Registry, error) {
+	r := &Registry{path: path, live: make(map[string]*Container)}
+	if _, err := r.read(); err != nil {
+		errlog.Println("OpenRegistry:", err)
+		return nil, err
+	}
+	return r, nil
+}
+
+// Save adds the definition of the container to the registry, or replaces
+// the one of the same name. Call it again after changing the container.
+func (r *Registry) Save(c *Container) error {
+	def := c.Definition()
+	if def.Name == "" {
+		return errors.New("Save: the container has no name")
+	}
+	base, err := filepath.Abs(def.BaseDir)
+	if err != nil {
+		return err
+	}
+	def.BaseDir = base
+	err = r.update(func(st *registryState) error {
+		for i := range st.Containers {
+			if st.Containers[i].Name == def.Name {
+				st.Containers[i] = def
+				return nil
+			}
+		}
+		st.Containers = append(st.Containers, def)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	r.lock.Lock()
+	r.live[def.Name] = c
+	r.lock.Unlock()
+	return nil
+}
+
+// Remove removes the definition of a container from the registry. The
+// container and its layers are not changed.
+func (r *Registry) Remove(name string) error {
+	err := r.update(func(st *registryState) error {
+		for i := range st.Containers {
+			if st.Containers[i].Name == name {
+				st.Containers = append(st.Containers[:i], st.Containers[i+1:]...)
+				return nil
+			}
+		}
+		return ErrNoContainer
+	})
+	if err != nil {
+		return err
+	}
+	r.lock.Lock()
+	delete(r.live, name)
+	r.lock.Unlock()
+	return nil
+}
+
+// Definitions returns the definitions in the registry, sorted by name.
+func (r *Registry) Definitions() ([]ContainerDef, error) {
+	st, err := r.read()
+	if err != nil {
+		return nil, err
+	}
+	return st.Containers, nil
+}
+
+// Load creates the container of the name from its definition. If it has
+// been saved or loaded by this process, the same container is returned.
+func (r *Registry) Load(name string) (*Container, error) {
+	r.lock.Lock()
+	c, ok := r.live[name]
+	r.lock.Unlock()
+	if ok {
+		return c, nil
+	}
+	defs, err := r.Definitions()
+	if err != nil {
+		return nil, err
+	}
+	for _, def := range defs {
+		if def.Name == name {
+			return r.load(def)
+		}
+	}
+	return nil, ErrNoContainer
+}
+
+// LoadAll creates all containers in the registry, see Load().
+func (r *Registry) LoadAll() ([]*Container, error) {
+	defs, err := r.Definitions()
+	if err != nil {
+		return nil, err
+	}
+	cs := make([]*Container, 0, len(defs))
+	for _, def := range defs {
+		r.lock.Lock()
+		c, ok := r.live[def.Name]
+		r.lock.Unlock()
+		if !ok {
+			if c, err = r.load(def); err != nil {
+				return nil, err
+			}
+		}
+		cs = append(cs, c)
+	}
+	return cs, nil
+}
+
+func (r *Registry) load(def ContainerDef) (*Container, error) {
+	c, err := def.container()
+	if err != nil {
+		errlog.Println("Registry.Load:", err)
+		return nil, err
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if live, ok := r.live[def.Name]; ok {
+		return live, nil
+	}
+	r.live[def.Name] = c
+	return c, nil
+}
+
+// List returns the containers in the registry with their live status. The
+// file systems mounted by other processes are found in /proc/self/mountinfo,
+// except the rootless ones, which are in other mount namespaces.
+func (r *Registry) List() ([]ContainerStatus, error) {
+	defs, err := r.Definitions()
+	if err != nil {
+		return nil, err
+	}
+	mounts, err := overlayMounts()
+	if err != nil {
+		warnlog.Println("Registry.List:", err)
+	}
+	list := make([]ContainerStatus, len(defs))
+	for i, def := range defs {
+		st := ContainerStatus{ContainerDef: def}
+		if len(def.Layers) != 0 {
+			top := filepath.Join(def.BaseDir, def.Layers[0])
+			for _, m := range mounts {
+				if m.hasTop(def.BaseDir, top) {
+					st.MountPoint = m.mountPoint
+				}
+			}
+			st.Mounted = st.MountPoint != ""
+		}
+		r.lock.Lock()
+		c, ok := r.live[def.Name]
+		r.lock.Unlock()
+		if ok && c.Fs.IsMounted() {
+			c.Fs.lock.RLock()
+			st.Mounted, st.MountPoint = true, c.Fs.TargetDir()
+			c.Fs.lock.RUnlock()
+		}
+		st.Machine = machineRegistered(def.Name)
+		st.Booted = st.Machine && systemRunning(def.Name)
+		list[i] = st
+	}
+	return list, nil
+}
+
+// read reads the state file. A missing file is an empty registry.
+func (r *Registry) read() (*registryState, error) {
+	st := new(registryState)
+	b, err := ioutil.ReadFile(r.path)
+	if os.IsNotExist(err) {
+		return st, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(b, st); err != nil {
+		return nil, fmt.Errorf("%s: %v", r.path, err)
+	}
+	return st, nil
+}
+
+// update changes the state file by fn, while holding the lock file beside it.
+func (r *Registry) update(fn func(st *registryState) error) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if err := os.MkdirAll(filepath.Dir(r.path), 0755); err != nil {
+		return err
+	}
+	lock, err := os.OpenFile(r.path+".lock", os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	defer lock.Close()
+	if err := syscall.Flock(int(lock.Fd()), syscall.LOCK_EX); err != nil {
+		return os.NewSyscallError("flock", err)
+	}
+
+	st, err := r.read()
+	if err != nil {
+		return err
+	}
+	if err := fn(st); err != nil {
+		return err
+	}
+	sort.Slice(st.Containers, func(i, j int) bool {
+		return st.Containers[i].Name < st.Containers[j].Name
+	})
+	b, err := json.MarshalIndent(st, "", "  ")
+	if err != nil {
+		return err
+	}
+	// write to a temporary file, and replace the old one atomically.
+	if err := ioutil.WriteFile(r.path+".tmp", append(b, '\n'), 0644); err != nil {
+		return err
+	}
+	return os.Rename(r.path+".tmp", r.path)
+}
+
+// overlayMount is a mounted overlay file system.
+type overlayMount struct {
+	mountPoint string
+	upper      string
+	lowers     []string
+}
+
+// hasTop returns whether dir is the top layer of the mount, which is the upper
+// directory, or the highest lower directory of read-only and ephemeral mounts.
+// The paths of a mount by fsMountRelative() are relative to the directory of
+// the bottom layer, so they are resolved against base, if all the lower
+// directories are there.
+func (m overlayMount) hasTop(base, dir string) bool {
+	var tops []string
+	if m.upper != "" {
+		tops = append(tops, m.upper)
+	}
+	if len(m.lowers) != 0 {
+		tops = append(tops, m.lowers[0])
+	}
+	for _, top := range tops {
+		if filepath.IsAbs(top) {
+			if top == dir {
+				return true
+			}
+			continue
+		}
+		if filepath.Join(base, top) != dir {
+			continue
+		}
+		for _, lower := range m.lowers {
+			if filepath.IsAbs(lower) || !exists(filepath.Join(base, lower)) {
+				return false
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// overlayMounts returns the mounted overlay file systems.
+func overlayMounts() ([]overlayMount, error) {
+	f, err := os.Open("/proc/self/mountinfo")
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var mounts []overlayMount
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		// eg. "36 25 0:32 / /tmp/ciel.X rw,relatime shared:1 - overlay overlay rw,lowerdir=...,upperdir=..."
+		fields := strings.Fields(scanner.Text())
+		sep := -1
+		for i, field := range fields {
+			if field == "-" {
+				sep = i
+				break
+			}
+		}
+		if sep < 5 || len(fields) < sep+4 || fields[sep+1] != "overlay" {
+			continue
+		}
+		m := overlayMount{mountPoint: unescapeMountinfo(fields[4])}
+		for _, opt := range strings.Split(fields[sep+3], ",") {
+			if strings.HasPrefix(opt, "upperdir=") {
+				m.upper = unescapeMountinfo(strings.TrimPrefix(opt, "upperdir="))
+			} else if strings.HasPrefix(opt, "lowerdir=") {
+				for _, lower := range strings.Split(strings.TrimPrefix(opt, "lowerdir="), ":") {
+					m.lowers = append(m.lowers, unescapeMountinfo(lower))
+				}
+			}
+		}
+		mounts = append(mounts, m)
+	}
+	return mounts, scanner.Err()
+}
+
+// unescapeMountinfo decodes the octal escapes of /proc/self/mountinfo,
+// eg. "\040" for a space.
+func unescapeMountinfo(s string) string {
+	if !strings.Contains(s, `\`) {
+		return s
+	}
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+4 <= len(s) {
+			if n, err := strconv.ParseUint(s[i+1:i+4], 8, 8); err == nil {
+				b.WriteByte(byte(n))
+				i += 3
+				continue
+			}
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
+
+// machineRegistered returns whether a machine of the name is registered to
+// systemd-machined, by a booted container or one in chroot-mode.
+func machineRegistered(name string) bool {
+	err := exec.Command(MachinectlnProc, "status", name).Run()
+	dbglog.Println("machineRegistered:", name, err)
+	return err == nil
+}
+
+// systemRunning returns whether systemd is running in the machine.
+func systemRunning(name string) bool {
+	a, _ := exec.Command(SystemctlnProc, "is-system-running", "-M", name).Output()
+	switch strings.TrimSpace(string(a)) {
+	case "running", "degraded":
+		return true
+	}
+	return false
+}
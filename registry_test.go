@@ -0,0 +1,53 @@
+package ciel
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// TestOverlayMountsRelative checks that a mount by fsMountRelative(), with
+// paths relative to the base directory, is found by its top layer.
+func TestOverlayMountsRelative(t *testing.T) {
+	fs := newTestFileSystem(t, Layers{"99-top", "50-middle", "00-bottom"}, nil, false)
+	other := newTestFileSystem(t, Layers{"99-top", "00-bottom"}, nil, false)
+	target, err := ioutil.TempDir("", "ciel-test.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(target)
+	workdir := fs.TopLayerWorkDir()
+	if err := os.Mkdir(workdir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	lowerdirs := []string{fs.Layer("middle"), fs.Layer("bottom")}
+	if err := fsMountRelative(target, fs.TopLayer(), workdir, lowerdirs, nil); err != nil {
+		t.Skip("overlayfs:", err)
+	}
+	defer fsUnmount(target)
+
+	mounts, err := overlayMounts()
+	if err != nil {
+		t.Fatal(err)
+	}
+	found := false
+	for _, m := range mounts {
+		if m.mountPoint != target {
+			continue
+		}
+		found = true
+		if filepath.IsAbs(m.upper) {
+			t.Fatalf("the upper directory %q is not relative", m.upper)
+		}
+		if !m.hasTop(fs.base, fs.TopLayer()) {
+			t.Errorf("%+v has no top layer %s", m, fs.TopLayer())
+		}
+		if m.hasTop(other.base, other.TopLayer()) {
+			t.Errorf("%+v has the top layer %s of another file system", m, other.TopLayer())
+		}
+	}
+	if !found {
+		t.Fatal("no mount at", target)
+	}
+}
@@ -19,6 +19,7 @@ const (
 
 func (c *Container) systemdNspawnBoot() {
 	c.Fs.lock.RLock()
+	c.lock.RLock()
 	args := []string{
 		"--boot",
 		"-M", c.Name,
@@ -27,6 +28,9 @@ func (c *Container) systemdNspawnBoot() {
 	for _, p := range c.properties {
 		args = append(args, "--property="+p)
 	}
+	args = append(args, c.privUsers.args()...)
+	args = append(args, c.readOnlyArgs()...)
+	c.lock.RUnlock()
 	dbglog.Println("systemdNspawnBoot:", args)
 	cmd := exec.Command(SystemdNspawnProc, args...)
 	c.Fs.lock.RUnlock()
@@ -65,6 +69,17 @@ func (c *Container) systemdNspawnBoot() {
 	infolog.Println("wait for booted...OK")
 }
 
+// recordOwnershipShift records the shift of the top layer after
+// systemd-nspawn ran with the ownership "chown", see PrivateUsers.
+func (c *Container) recordOwnershipShift() {
+	c.lock.RLock()
+	chown := c.privUsers.Ownership == "chown"
+	c.lock.RUnlock()
+	if chown {
+		c.Fs.recordOwnershipShift()
+	}
+}
+
 func (c *Container) isSystemRunning() bool {
 	a, err := exec.Command(SystemctlnProc, "is-system-running", "-M", c.Name).Output()
 	dbglog.Println("isSystemRunning:", err, strings.TrimSpace(string(a)))
@@ -109,6 +124,8 @@ func (c *Container) isSystemShutdown() bool {
 }
 
 func (c *Container) machinectlShutdown() error {
+	// the file system is never locked after the container.
+	rootless := c.Fs.IsRootless()
 	c.lock.Lock()
 	defer c.lock.Unlock()
 
@@ -116,6 +133,9 @@ func (c *Container) machinectlShutdown() error {
 	if c.booted {
 		dbglog.Println("machinectlShutdown: poweroff")
 		cmd = exec.Command(MachinectlnProc, "shell", c.Name, "/bin/systemctl", "poweroff")
+	} else if c.chrooted && rootless {
+		// it's not registered to systemd-machined.
+		return ErrRootless
 	} else if c.chrooted {
 		dbglog.Println("machinectlShutdown: terminate")
 		cmd = exec.Command(MachinectlnProc, "terminate", c.Name)
@@ -164,14 +184,24 @@ func (c *Container) systemdNspawnRun(ctx context.Context, proc string, stdin io.
 		errlog.Panic("another chroot-mode instance is running")
 	}
 
+	runner := SystemdNspawnProc
 	subArgs := append([]string{proc}, args...)
-	c.Fs.lock.RLock()
-	subArgs = append([]string{
-		"--quiet",
-		"-M", c.Name,
-		"-D", c.Fs.TargetDir(),
-	}, subArgs...)
-	c.Fs.lock.RUnlock()
+	if c.Fs.IsRootless() {
+		runner = NsenterProc
+		subArgs = c.Fs.rootlessCommand(proc, args...)
+	} else {
+		c.Fs.lock.RLock()
+		c.lock.RLock()
+		nspawnArgs := append([]string{
+			"--quiet",
+			"-M", c.Name,
+			"-D", c.Fs.TargetDir(),
+		}, c.privUsers.args()...)
+		nspawnArgs = append(nspawnArgs, c.readOnlyArgs()...)
+		c.lock.RUnlock()
+		subArgs = append(nspawnArgs, subArgs...)
+		c.Fs.lock.RUnlock()
+	}
 
 	c.lock.Lock()
 	c.chrooted = true
@@ -181,8 +211,12 @@ func (c *Container) systemdNspawnRun(ctx context.Context, proc string, stdin io.
 		c.chrooted = false
 		c.lock.Unlock()
 	}()
-	infolog.Println("systemd-nspawn")
-	return cmd(ctx, SystemdNspawnProc, stdin, stdout, stderr, subArgs...)
+	infolog.Println(runner)
+	exitStatus := cmd(ctx, runner, stdin, stdout, stderr, subArgs...)
+	if runner == SystemdNspawnProc {
+		c.recordOwnershipShift()
+	}
+	return exitStatus
 }
 
 func cmd(ctx context.Context, proc string, stdin io.Reader, stdout, stderr io.Writer, args ...string) int {
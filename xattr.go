@@ -0,0 +1,184 @@
+package ciel
+
+import (
+	"strings"
+	"syscall"
+	"unsafe"
+)
+
+// The syscall package only provides the variants following symbolic links,
+// but layers are full of them, so the "l"-variants are implemented here.
+
+func lgetxattr(path, attr string) ([]byte, error) {
+	dest := make([]byte, 256)
+	for {
+		sz, err := lgetxattrRaw(path, attr, dest)
+		if err == syscall.ERANGE {
+			sz, err = lgetxattrRaw(path, attr, nil)
+			if err != nil {
+				return nil, err
+			}
+			dest = make([]byte, sz)
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		return dest[:sz], nil
+	}
+}
+
+func lgetxattrRaw(path, attr string, dest []byte) (int, error) {
+	p, err := syscall.BytePtrFromString(path)
+	if err != nil {
+		return 0, err
+	}
+	a, err := syscall.BytePtrFromString(attr)
+	if err != nil {
+		return 0, err
+	}
+	var d unsafe.Pointer
+	if len(dest) > 0 {
+		d = unsafe.Pointer(&dest[0])
+	}
+	r0, _, e1 := syscall.Syscall6(syscall.SYS_LGETXATTR,
+		uintptr(unsafe.Pointer(p)), uintptr(unsafe.Pointer(a)),
+		uintptr(d), uintptr(len(dest)), 0, 0)
+	if e1 != 0 {
+		return 0, e1
+	}
+	return int(r0), nil
+}
+
+// llistxattr returns the names of all extended attributes of the file.
+func llistxattr(path string) ([]string, error) {
+	p, err := syscall.BytePtrFromString(path)
+	if err != nil {
+		return nil, err
+	}
+	dest := make([]byte, 1024)
+	for {
+		r0, _, e1 := syscall.Syscall(syscall.SYS_LLISTXATTR,
+			uintptr(unsafe.Pointer(p)), uintptr(unsafe.Pointer(&dest[0])), uintptr(len(dest)))
+		if e1 == syscall.ERANGE {
+			dest = make([]byte, len(dest)*4)
+			continue
+		}
+		if e1 == syscall.ENOTSUP {
+			return nil, nil
+		}
+		if e1 != 0 {
+			return nil, e1
+		}
+		var names []string
+		for _, name := range strings.Split(string(dest[:r0]), "\x00") {
+			if name != "" {
+				names = append(names, name)
+			}
+		}
+		return names, nil
+	}
+}
+
+func lsetxattr(path, attr string, data []byte, flags int) error {
+	p, err := syscall.BytePtrFromString(path)
+	if err != nil {
+		return err
+	}
+	a, err := syscall.BytePtrFromString(attr)
+	if err != nil {
+		return err
+	}
+	var d unsafe.Pointer
+	if len(data) > 0 {
+		d = unsafe.Pointer(&data[0])
+	}
+	_, _, e1 := syscall.Syscall6(syscall.SYS_LSETXATTR,
+		uintptr(unsafe.Pointer(p)), uintptr(unsafe.Pointer(a)),
+		uintptr(d), uintptr(len(data)), uintptr(flags), 0)
+	if e1 != 0 {
+		return e1
+	}
+	return nil
+}
+
+func lremovexattr(path, attr string) error {
+	p, err := syscall.BytePtrFromString(path)
+	if err != nil {
+		return err
+	}
+	a, err := syscall.BytePtrFromString(attr)
+	if err != nil {
+		return err
+	}
+	_, _, e1 := syscall.Syscall(syscall.SYS_LREMOVEXATTR,
+		uintptr(unsafe.Pointer(p)), uintptr(unsafe.Pointer(a)), 0)
+	if e1 != 0 {
+		return e1
+	}
+	return nil
+}
+
+// lxattrs reads all extended attributes of the file.
+func lxattrs(path string) (map[string][]byte, error) {
+	names, err := llistxattr(path)
+	if err != nil {
+		return nil, err
+	}
+	xattrs := make(map[string][]byte, len(names))
+	for _, name := range names {
+		value, err := lgetxattr(path, name)
+		if err == syscall.ENODATA {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		xattrs[name] = value
+	}
+	return xattrs, nil
+}
+
+// Overlayfs keeps its private extended attributes in the "trusted.overlay."
+// namespace, or in "user.overlay." if mounted with the option "userxattr".
+const (
+	overlayXattrPrefix     = "trusted.overlay."
+	overlayUserXattrPrefix = "user.overlay."
+)
+
+// isOverlayXattr returns whether the extended attribute is private to
+// overlayfs, which is not a part of the content of the file.
+func isOverlayXattr(name string) bool {
+	return strings.HasPrefix(name, overlayXattrPrefix) || strings.HasPrefix(name, overlayUserXattrPrefix)
+}
+
+// isOpaque returns whether the directory is an opaque directory of overlayfs,
+// which hides the contents of lower layers.
+func isOpaque(path string) bool {
+	for _, prefix := range []string{overlayXattrPrefix, overlayUserXattrPrefix} {
+		value, err := lgetxattr(path, prefix+"opaque")
+		if err == nil && string(value) == "y" {
+			return true
+		}
+	}
+	return false
+}
+
+// setOpaque marks the directory as an opaque directory.
+func setOpaque(path string, userxattr bool) error {
+	prefix := overlayXattrPrefix
+	if userxattr {
+		prefix = overlayUserXattrPrefix
+	}
+	return lsetxattr(path, prefix+"opaque", []byte("y"), 0)
+}
+
+// clearOpaque turns an opaque directory into a normal one.
+func clearOpaque(path string) error {
+	for _, prefix := range []string{overlayXattrPrefix, overlayUserXattrPrefix} {
+		err := lremovexattr(path, prefix+"opaque")
+		if err != nil && err != syscall.ENODATA && err != syscall.ENOTSUP {
+			return err
+		}
+	}
+	return nil
+}